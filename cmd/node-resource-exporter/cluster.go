@@ -0,0 +1,251 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/dmitsh/node-resource-exporter/pkg/metrics"
+)
+
+// clusterUsage accumulates the cluster-wide statistics during the node loop.
+//
+// Only additive amounts, the resource requests and available amounts in their
+// reported units, are summed across nodes. Ratios such as the occupancy are
+// only aggregated by their maximum, as the sum of percentages of nodes of
+// different sizes is meaningless, and the occupancy of a group of nodes is
+// derived from the sums. The methods summing values take an amount, so that
+// a ratio cannot be summed without an explicit conversion.
+type clusterUsage struct {
+	// maxOccupancy holds the most loaded node for each resource
+	maxOccupancy map[string]nodeOccupancy
+	// occupancies holds the occupancy of each node for each resource
+	occupancies map[string][]float64
+	// pools holds the occupancies of the nodes of each -pool-label value and
+	// resource
+	pools map[[2]string]*poolOccupancy
+	// instanceTypes and zones hold the occupied and total amounts of the
+	// nodes of each -instance-type-label and -zone-label value and resource
+	instanceTypes map[[2]string]*summedOccupancy
+	zones         map[[2]string]*summedOccupancy
+	// requests holds the cluster total of each resource requests
+	requests map[string]amount
+	// available holds the cluster total of each resource allocatable and not
+	// requested yet
+	available map[string]amount
+	// podCounts holds the running pods of each node
+	podCounts []int
+	// nodeRequests holds the requests of each node, to report their fraction
+	// of the cluster total once all nodes are accounted for
+	nodeRequests []nodeResourceValue
+	// unscheduled holds the pending pods not bound to a node. It is nil when
+	// they were not listed.
+	unscheduled *unscheduledPods
+	// quotas holds the ResourceQuotas of all namespaces with -resource-quotas
+	quotas []corev1.ResourceQuota
+	// claimDevices holds the devices allocated to each ResourceClaim, by
+	// driver, with -resource-claims. It is nil when they were not listed.
+	claimDevices map[types.NamespacedName]map[string]int
+}
+
+type unscheduledPods struct {
+	// counts counts the pods by whether they request cpu or memory
+	counts map[bool]int
+	// largestRequests holds the largest request of each resource
+	largestRequests corev1.ResourceList
+	// unadvertisedRequests counts the pods requesting each extended resource
+	// no node advertises, which never schedule
+	unadvertisedRequests map[corev1.ResourceName]int
+}
+
+// amount is an additive quantity of a resource, in its reported units, which
+// may be summed across nodes unlike a ratio.
+type amount float64
+
+type nodeResourceValue struct {
+	labels   []string
+	resource string
+	value    amount
+}
+
+type nodeOccupancy struct {
+	node      string
+	occupancy float64
+}
+
+type summedOccupancy struct {
+	occupied, total amount
+}
+
+// occupancy returns the occupancy percentage of the group, the ratio of its
+// summed amounts.
+func (o *summedOccupancy) occupancy() float64 {
+	return float64(o.occupied / o.total * 100.0)
+}
+
+type poolOccupancy struct {
+	min, max, sum float64
+	nodes         int
+}
+
+func newClusterUsage() *clusterUsage {
+	return &clusterUsage{
+		maxOccupancy:  make(map[string]nodeOccupancy),
+		occupancies:   make(map[string][]float64),
+		pools:         make(map[[2]string]*poolOccupancy),
+		instanceTypes: make(map[[2]string]*summedOccupancy),
+		zones:         make(map[[2]string]*summedOccupancy),
+		requests:      make(map[string]amount),
+		available:     make(map[string]amount),
+	}
+}
+
+// addRequests adds the requests of a node resource. The labels are copied,
+// as the caller reuses them for the next resource.
+func (c *clusterUsage) addRequests(labels []string, resource string, requests amount) {
+	c.requests[resource] += requests
+	c.nodeRequests = append(c.nodeRequests, nodeResourceValue{labels: slices.Clone(labels), resource: resource, value: requests})
+}
+
+// addAvailable adds the allocatable amount of a node resource not requested
+// yet. The negative amount of an overcommitted node frees no other node.
+func (c *clusterUsage) addAvailable(resource string, available amount) {
+	c.available[resource] += max(available, 0)
+}
+
+// addOccupancy adds the occupancy percentage of a node resource, kept as the
+// maximum if it is the highest so far. Occupancies must never be summed, see
+// clusterUsage.
+func (c *clusterUsage) addOccupancy(node, resource string, occupancy float64) {
+	c.occupancies[resource] = append(c.occupancies[resource], occupancy)
+	if curr, ok := c.maxOccupancy[resource]; !ok || occupancy > curr.occupancy {
+		c.maxOccupancy[resource] = nodeOccupancy{node: node, occupancy: occupancy}
+	}
+}
+
+// addPoolOccupancy adds the occupancy percentage of a node resource to the
+// pool of the node. Every node of the pool weighs the same in the average.
+func (c *clusterUsage) addPoolOccupancy(pool, resource string, occupancy float64) {
+	key := [2]string{pool, resource}
+	p, ok := c.pools[key]
+	if !ok {
+		p = &poolOccupancy{min: occupancy, max: occupancy}
+		c.pools[key] = p
+	}
+	p.min = min(p.min, occupancy)
+	p.max = max(p.max, occupancy)
+	p.sum += occupancy
+	p.nodes++
+}
+
+// addSummedOccupancy adds the occupied amount of a node resource and its
+// occupancy denominator to the group of the node, such as its instance type.
+// The occupancy of the group is the ratio of the sums, see clusterUsage.
+func addSummedOccupancy(groups map[[2]string]*summedOccupancy, group, resource string, occupied, total amount) {
+	key := [2]string{group, resource}
+	g, ok := groups[key]
+	if !ok {
+		g = &summedOccupancy{}
+		groups[key] = g
+	}
+	g.occupied += occupied
+	g.total += total
+}
+
+// reportZoneSkew sets the difference between the most and least occupied
+// zones of each resource.
+func (c *clusterUsage) reportZoneSkew(metric *metrics.Snapshot) {
+	lowest, highest := make(map[string]float64), make(map[string]float64)
+	for key, z := range c.zones {
+		resource, occupancy := key[1], z.occupancy()
+		if low, ok := lowest[resource]; !ok || occupancy < low {
+			lowest[resource] = occupancy
+		}
+		if high, ok := highest[resource]; !ok || occupancy > high {
+			highest[resource] = occupancy
+		}
+	}
+	for resource, high := range highest {
+		metric.ZoneResourceOccupancySkew.WithLabelValues(resource).Set(round(high - lowest[resource]))
+	}
+}
+
+// addPodCount adds the running pods of a node to the pods per node
+// distribution.
+func (c *clusterUsage) addPodCount(pods int) {
+	c.podCounts = append(c.podCounts, pods)
+}
+
+// reportPodCounts reports the pods per node distribution as cumulative bucket
+// gauges, set anew on every pass rather than accumulated like a histogram.
+func (c *clusterUsage) reportPodCounts(metric *metrics.Snapshot) {
+	total := 0
+	for _, pods := range c.podCounts {
+		total += pods
+	}
+	for _, le := range metrics.NodePodCountBuckets {
+		nodes := 0
+		for _, pods := range c.podCounts {
+			if float64(pods) <= le {
+				nodes++
+			}
+		}
+		metric.NodePodCountBucket.WithLabelValues(strconv.FormatFloat(le, 'g', -1, 64)).Set(float64(nodes))
+	}
+	metric.NodePodCountBucket.WithLabelValues("+Inf").Set(float64(len(c.podCounts)))
+	metric.NodePodCountCount.Set(float64(len(c.podCounts)))
+	metric.NodePodCountSum.Set(float64(total))
+}
+
+func (c *clusterUsage) report(metric *metrics.Snapshot) {
+	for resource, top := range c.maxOccupancy {
+		metric.ClusterMaxNodeOccupancy.WithLabelValues(resource).Set(round(top.occupancy))
+		metric.ClusterMaxNodeOccupancyInfo.WithLabelValues(resource, top.node).Set(1)
+	}
+	for key, p := range c.pools {
+		metric.PoolResourceOccupancyMin.WithLabelValues(key[0], key[1]).Set(round(p.min))
+		metric.PoolResourceOccupancyMax.WithLabelValues(key[0], key[1]).Set(round(p.max))
+		metric.PoolResourceOccupancyAvg.WithLabelValues(key[0], key[1]).Set(round(p.sum / float64(p.nodes)))
+	}
+	for key, t := range c.instanceTypes {
+		metric.InstanceTypeResourceOccupancy.WithLabelValues(key[0], key[1]).Set(round(t.occupancy()))
+	}
+	c.reportZoneSkew(metric)
+	c.reportPodCounts(metric)
+	for resource, available := range c.available {
+		metric.ClusterResourceAvailable.WithLabelValues(resource).Set(float64(available))
+	}
+	for _, v := range c.nodeRequests {
+		if total := c.requests[v.resource]; total > 0 {
+			metric.NodeResourceRequestsClusterFraction.WithLabelValues(v.labels...).Set(round(float64(v.value / total)))
+		}
+	}
+	if c.unscheduled != nil {
+		for _, requests := range []bool{false, true} {
+			metric.ClusterUnscheduledPodCount.WithLabelValues(strconv.FormatBool(requests)).Set(float64(c.unscheduled.counts[requests]))
+		}
+		for name, pods := range c.unscheduled.unadvertisedRequests {
+			metric.ClusterUnschedulableResource.WithLabelValues(resourceLabelValue(string(name))).Set(float64(pods))
+		}
+	}
+	for i := range c.quotas {
+		quota := &c.quotas[i]
+		for name, hard := range quota.Status.Hard {
+			metric.NamespaceResourceQuotaHard.WithLabelValues(quota.Namespace, quota.Name, string(name)).Set(quantityValue(quotaResource(name), hard))
+		}
+		for name, used := range quota.Status.Used {
+			metric.NamespaceResourceQuotaUsed.WithLabelValues(quota.Namespace, quota.Name, string(name)).Set(quantityValue(quotaResource(name), used))
+		}
+	}
+}
+
+// quotaResource returns the resource a ResourceQuota entry constrains, e.g.
+// cpu for requests.cpu and limits.cpu, to convert its amounts like those of
+// the resource.
+func quotaResource(name corev1.ResourceName) string {
+	resource := strings.TrimPrefix(string(name), "requests.")
+	return strings.TrimPrefix(resource, "limits.")
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/dmitsh/node-resource-exporter/pkg/metrics"
+)
+
+// newTestSnapshot returns an empty snapshot of metrics registered into a
+// registry of the test.
+func newTestSnapshot() *metrics.Snapshot {
+	return metrics.New(prometheus.NewRegistry(), "node", nil, nil).NewSnapshot()
+}
+
+func TestReportPodCounts(t *testing.T) {
+	tests := []struct {
+		name      string
+		podCounts []int
+		// wantNodes holds the nodes of each bucket
+		wantNodes map[string]float64
+		wantPods  float64
+	}{
+		{
+			name:      "no nodes",
+			wantNodes: map[string]float64{"0": 0, "5": 0, "250": 0, "+Inf": 0},
+		},
+		{
+			name:      "nodes of several buckets",
+			podCounts: []int{0, 5, 6, 30, 300},
+			wantNodes: map[string]float64{"0": 1, "5": 2, "10": 3, "20": 3, "30": 4, "250": 4, "+Inf": 5},
+			wantPods:  341,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newClusterUsage()
+			for _, pods := range tt.podCounts {
+				c.addPodCount(pods)
+			}
+			snapshot := newTestSnapshot()
+			c.reportPodCounts(snapshot)
+			for le, want := range tt.wantNodes {
+				if got := testutil.ToFloat64(snapshot.NodePodCountBucket.WithLabelValues(le)); got != want {
+					t.Errorf("le %s: %v nodes, want %v", le, got, want)
+				}
+			}
+			if got, want := testutil.ToFloat64(snapshot.NodePodCountCount), float64(len(tt.podCounts)); got != want {
+				t.Errorf("%v nodes counted, want %v", got, want)
+			}
+			if got := testutil.ToFloat64(snapshot.NodePodCountSum); got != tt.wantPods {
+				t.Errorf("%v running pods, want %v", got, tt.wantPods)
+			}
+			if got, want := testutil.CollectAndCount(snapshot.NodePodCountBucket), len(metrics.NodePodCountBuckets)+1; got != want {
+				t.Errorf("%d buckets, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestClusterAggregationSumsOnlyAmounts(t *testing.T) {
+	setFlag(t, &nodeLabelKey, "node")
+	setFlag(t, &occupancyBasis, basisAllocatable)
+	setFlag(t, &roundDigits, -1)
+	setFlag(t, &instanceTypeLabel, corev1.LabelInstanceTypeStable)
+
+	// a full small node and a quarter full large one of the same type
+	nodes := []corev1.Node{newNode("small", resourceList("cpu", "2")), newNode("large", resourceList("cpu", "8"))}
+	for i := range nodes {
+		nodes[i].Labels = map[string]string{corev1.LabelInstanceTypeStable: "mixed"}
+	}
+	s := newTestSampler(t, newFakeClient())
+	reportTestNodes(t, s, nodes, []string{"cpu"},
+		newPod("s1", "small", corev1.PodRunning, newContainer("c", resourceList("cpu", "2"), nil)),
+		newPod("l1", "large", corev1.PodRunning, newContainer("c", resourceList("cpu", "2"), nil)))
+
+	tests := []struct {
+		metric, labels string
+		// want is the aggregate of the amounts, unlike the sum 125 and the
+		// average 62.5 of the occupancies
+		want float64
+	}{
+		{metric: "cluster_resource_available", labels: `resource="cpu"`, want: 6},
+		{metric: "instancetype_resource_occupancy", labels: `instance_type="mixed",resource="cpu"`, want: 40},
+		{metric: "cluster_max_node_occupancy", labels: `resource="cpu"`, want: 100},
+		{metric: "node_resource_requests_cluster_fraction", labels: `node="small",resource="cpu"`, want: 0.5},
+	}
+	for _, tt := range tests {
+		if got, ok := gatherSeries(t, s, tt.metric)[tt.labels]; !ok || got != tt.want {
+			t.Errorf("%s{%s} = %v (present %v), want %v", tt.metric, tt.labels, got, ok, tt.want)
+		}
+	}
+}
+
+func TestReportQuotas(t *testing.T) {
+	setFlag(t, &cpuUnit, cpuMillicores)
+	setFlag(t, &resourceScales, map[string]float64{"memory": 0.5})
+	c := newClusterUsage()
+	c.quotas = []corev1.ResourceQuota{{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team", Name: "compute"},
+		Status: corev1.ResourceQuotaStatus{
+			Hard: resourceList("requests.cpu", "2", "limits.memory", "4Ki", "pods", "10"),
+			Used: resourceList("requests.cpu", "1500m", "limits.memory", "2Ki", "pods", "3"),
+		},
+	}}
+	snapshot := newTestSnapshot()
+	c.report(snapshot)
+	for _, tt := range []struct {
+		metric   *prometheus.GaugeVec
+		resource string
+		want     float64
+	}{
+		{snapshot.NamespaceResourceQuotaHard, "requests.cpu", 2000},
+		{snapshot.NamespaceResourceQuotaUsed, "requests.cpu", 1500},
+		{snapshot.NamespaceResourceQuotaHard, "limits.memory", 2048},
+		{snapshot.NamespaceResourceQuotaUsed, "limits.memory", 1024},
+		{snapshot.NamespaceResourceQuotaHard, "pods", 10},
+		{snapshot.NamespaceResourceQuotaUsed, "pods", 3},
+	} {
+		if got := testutil.ToFloat64(tt.metric.WithLabelValues("team", "compute", tt.resource)); got != tt.want {
+			t.Errorf("%s: %v, want %v", tt.resource, got, tt.want)
+		}
+	}
+}
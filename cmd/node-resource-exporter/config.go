@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+
+	log "k8s.io/klog/v2"
+
+	"github.com/dmitsh/node-resource-exporter/pkg/metrics"
+)
+
+// reloadableFlags are the flags -config-file may set, at start and on SIGHUP.
+var reloadableFlags = map[string]bool{
+	"r":                 true,
+	"l":                 true,
+	"exclude-resources": true,
+}
+
+// configMu guards the configuration derived from the reloadable flags. It is
+// read-locked for a whole sampling pass, so that a reload waits for the
+// in-flight passes of all the clusters.
+var configMu sync.RWMutex
+
+// loadConfigFile sets the reloadable flags from the name=value lines of the
+// file. Empty lines and lines starting with '#' are ignored.
+func loadConfigFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimPrefix(strings.TrimSpace(name), "-")
+		if !ok || !reloadableFlags[name] {
+			return fmt.Errorf("invalid line %d of config file %s: %q", lineNum, path, line)
+		}
+		values[name] = strings.TrimSpace(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for name, value := range values {
+		if err := flag.Set(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyConfig derives the tracked resources, the excluded resources and the
+// node label keys from the reloadable flags.
+func applyConfig() {
+	trackedResourceNames = parseList(resources, "-r")
+	excludedResources = make(map[string]bool)
+	for _, resource := range parseList(excludeResources, "-exclude-resources") {
+		excludedResources[resource] = true
+	}
+	nodeLabelKeys = parseList(nodeLabels, "-l")
+	if includeArchOS {
+		nodeLabelKeys = slices.DeleteFunc(nodeLabelKeys, func(key string) bool {
+			if key == archLabelName || key == osLabelName {
+				log.Warningf("Ignoring %q in -l, set from the node info with -include-arch-os", key)
+				return true
+			}
+			return false
+		})
+	}
+}
+
+// Names of the labels of the node architecture and operating system.
+const (
+	archLabelName = "arch"
+	osLabelName   = "os"
+)
+
+// nodeLabelNames returns the names of the node labels passed onto the metrics.
+func nodeLabelNames() []string {
+	var names []string
+	if labelsMode == labelsJoined {
+		names = []string{joinedLabelName}
+	} else {
+		names = slices.Clone(nodeLabelKeys)
+	}
+	if includeArchOS {
+		names = append(names, archLabelName, osLabelName)
+	}
+	return names
+}
+
+// checkNodeLabelKey returns an error if the -node-label-key label collides
+// with another label of the metrics, which would fail their registration.
+func checkNodeLabelKey() error {
+	for _, name := range append([]string{"resource", "cluster"}, nodeLabelNames()...) {
+		if name == nodeLabelKey {
+			return fmt.Errorf("node label key %q collides with the %q label of the metrics, choose a different one with -node-label-key", nodeLabelKey, name)
+		}
+	}
+	return nil
+}
+
+// reloadableConfig holds the reloadable flags and the configuration derived
+// from them.
+type reloadableConfig struct {
+	resources, excludeResources, nodeLabels string
+	trackedResourceNames                    []string
+	excludedResources                       map[string]bool
+	nodeLabelKeys                           []string
+}
+
+// currentConfig returns the current reloadable configuration.
+func currentConfig() reloadableConfig {
+	return reloadableConfig{
+		resources:            resources,
+		excludeResources:     excludeResources,
+		nodeLabels:           nodeLabels,
+		trackedResourceNames: trackedResourceNames,
+		excludedResources:    excludedResources,
+		nodeLabelKeys:        nodeLabelKeys,
+	}
+}
+
+// restore sets the reloadable flags and the configuration derived from them
+// back to c.
+func (c reloadableConfig) restore() {
+	resources, excludeResources, nodeLabels = c.resources, c.excludeResources, c.nodeLabels
+	trackedResourceNames, excludedResources, nodeLabelKeys = c.trackedResourceNames, c.excludedResources, c.nodeLabelKeys
+}
+
+// reloadConfig reloads the reloadable flags from -config-file and registers
+// the metrics of the samplers anew with the new node labels. If the file or
+// the configuration it sets is invalid, the previous configuration is
+// restored, so that the metrics keep the labels they were registered with.
+func reloadConfig(samplers []*sampler, units map[string]string) (err error) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	previous := currentConfig()
+	defer func() {
+		if err != nil {
+			previous.restore()
+		}
+	}()
+	if err := loadConfigFile(configFile); err != nil {
+		return err
+	}
+	applyConfig()
+	if err := checkNodeLabelKey(); err != nil {
+		return err
+	}
+	if _, err := parseResourceAliases(resourceAliasesStr, trackedResourceNames); err != nil {
+		return err
+	}
+	for _, s := range samplers {
+		metrics.New(s.reg, nodeLabelKey, nodeLabelNames(), units)
+	}
+	return nil
+}
+
+// startConfigReloader calls reload on every SIGHUP until the context is canceled.
+func startConfigReloader(ctx context.Context, reload func() error) error {
+	defer log.Infof("Exited config reloader")
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	for {
+		select {
+		case <-sighup:
+			if err := reload(); err != nil {
+				log.Infof("ERROR: failed to reload %s, keeping the previous configuration: %v", configFile, err)
+				continue
+			}
+			log.Infof("Reloaded %s", configFile)
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
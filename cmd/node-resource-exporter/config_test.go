@@ -0,0 +1,189 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestCheckNodeLabelKey(t *testing.T) {
+	tests := []struct {
+		name         string
+		nodeLabelKey string
+		labels       []string
+		labelsMode   string
+		archOS       bool
+		wantErr      bool
+	}{
+		{name: "default key", nodeLabelKey: "node", labels: []string{"zone"}},
+		{name: "resource label", nodeLabelKey: "resource", wantErr: true},
+		{name: "cluster label", nodeLabelKey: "cluster", wantErr: true},
+		{name: "node label of -l", nodeLabelKey: "zone", labels: []string{"zone"}, wantErr: true},
+		{name: "node label of -l in joined mode", nodeLabelKey: "zone", labels: []string{"zone"}, labelsMode: labelsJoined},
+		{name: "joined node labels", nodeLabelKey: joinedLabelName, labels: []string{"zone"}, labelsMode: labelsJoined, wantErr: true},
+		{name: "node info label", nodeLabelKey: archLabelName, archOS: true, wantErr: true},
+		{name: "node info label without -include-arch-os", nodeLabelKey: archLabelName},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, &nodeLabelKey, tt.nodeLabelKey)
+			setFlag(t, &nodeLabelKeys, tt.labels)
+			setFlag(t, &labelsMode, tt.labelsMode)
+			setFlag(t, &includeArchOS, tt.archOS)
+			if err := checkNodeLabelKey(); (err != nil) != tt.wantErr {
+				t.Errorf("error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNodeLabelsArchOS(t *testing.T) {
+	setFlag(t, &nodeLabelKey, "node")
+	setFlag(t, &occupancyBasis, basisAllocatable)
+	setFlag(t, &nodeLabels, "zone,arch")
+
+	node := newNode("node-a", resourceList("cpu", "1"))
+	// the arch label disagrees with the architecture the kubelet reports
+	node.Labels = map[string]string{"zone": "zone-a", "arch": "amd64"}
+	node.Status.NodeInfo = corev1.NodeSystemInfo{Architecture: "arm64", OperatingSystem: "linux"}
+
+	tests := []struct {
+		name       string
+		labelsMode string
+		archOS     bool
+		wantNames  []string
+		wantValues []string
+		wantSeries string
+	}{
+		{
+			name:       "separate labels",
+			labelsMode: labelsSeparate,
+			wantNames:  []string{"zone", "arch"},
+			wantValues: []string{"zone-a", "amd64"},
+			wantSeries: `arch="amd64",node="node-a",resource="cpu",zone="zone-a"`,
+		},
+		{
+			name:       "separate labels and node info",
+			labelsMode: labelsSeparate,
+			archOS:     true,
+			wantNames:  []string{"zone", "arch", "os"},
+			wantValues: []string{"zone-a", "arm64", "linux"},
+			wantSeries: `arch="arm64",node="node-a",os="linux",resource="cpu",zone="zone-a"`,
+		},
+		{
+			name:       "joined labels",
+			labelsMode: labelsJoined,
+			wantNames:  []string{joinedLabelName},
+			wantValues: []string{"zone=zone-a,arch=amd64"},
+			wantSeries: `node="node-a",node_labels="zone=zone-a,arch=amd64",resource="cpu"`,
+		},
+		{
+			name:       "joined labels and node info",
+			labelsMode: labelsJoined,
+			archOS:     true,
+			wantNames:  []string{joinedLabelName, "arch", "os"},
+			wantValues: []string{"zone=zone-a", "arm64", "linux"},
+			wantSeries: `arch="arm64",node="node-a",node_labels="zone=zone-a",os="linux",resource="cpu"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, &labelsMode, tt.labelsMode)
+			setFlag(t, &includeArchOS, tt.archOS)
+			setFlag(t, &nodeLabelKeys, nil)
+			setFlag(t, &trackedResourceNames, nil)
+			setFlag(t, &excludedResources, nil)
+			applyConfig()
+
+			if names := nodeLabelNames(); !slices.Equal(names, tt.wantNames) {
+				t.Errorf("label names %q, want %q", names, tt.wantNames)
+			}
+			if values := getNodeLabelValues(&node); !slices.Equal(values, tt.wantValues) {
+				t.Errorf("label values %q, want %q", values, tt.wantValues)
+			}
+			s := newTestSampler(t, newFakeClient())
+			reportTestNodes(t, s, []corev1.Node{node}, []string{"cpu"})
+			if _, ok := gatherSeries(t, s, "node_resource_requests")[tt.wantSeries]; !ok {
+				t.Errorf("no node_resource_requests{%s} series in %v", tt.wantSeries, gatherSeries(t, s, "node_resource_requests"))
+			}
+		})
+	}
+}
+
+// defineReloadableFlags defines the reloadable flags, which main defines, for
+// loadConfigFile to set them.
+func defineReloadableFlags() {
+	for name, value := range map[string]*string{"r": &resources, "exclude-resources": &excludeResources, "l": &nodeLabels} {
+		if flag.Lookup(name) == nil {
+			flag.StringVar(value, name, "", "")
+		}
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	defineReloadableFlags()
+	setFlag(t, &nodeLabelKey, "node")
+	setFlag(t, &occupancyBasis, basisAllocatable)
+
+	node := newNode("node-a", resourceList("cpu", "1"))
+	node.Labels = map[string]string{"zone": "zone-a", "rack": "rack-a"}
+
+	tests := []struct {
+		name       string
+		config     string
+		wantErr    bool
+		wantLabels []string
+		wantSeries string
+	}{
+		{
+			name:       "node labels changed",
+			config:     "l=rack\n",
+			wantLabels: []string{"rack"},
+			wantSeries: `node="node-a",rack="rack-a",resource="cpu"`,
+		},
+		{
+			name:       "node label colliding with the node label key",
+			config:     "r=memory\nl=node\n",
+			wantErr:    true,
+			wantLabels: []string{"zone"},
+			wantSeries: `node="node-a",resource="cpu",zone="zone-a"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, &resources, "cpu")
+			setFlag(t, &excludeResources, "")
+			setFlag(t, &nodeLabels, "zone")
+			setFlag(t, &trackedResourceNames, nil)
+			setFlag(t, &excludedResources, nil)
+			setFlag(t, &nodeLabelKeys, nil)
+			applyConfig()
+			s := newTestSampler(t, newFakeClient())
+			reportTestNodes(t, s, []corev1.Node{node}, trackedResourceNames)
+
+			path := filepath.Join(t.TempDir(), "config")
+			if err := os.WriteFile(path, []byte(tt.config), 0o600); err != nil {
+				t.Fatalf("writing the config file: %v", err)
+			}
+			setFlag(t, &configFile, path)
+			if err := reloadConfig([]*sampler{s}, nil); (err != nil) != tt.wantErr {
+				t.Fatalf("reload error %v, want error %v", err, tt.wantErr)
+			}
+			if !slices.Equal(nodeLabelKeys, tt.wantLabels) {
+				t.Errorf("node label keys %q, want %q", nodeLabelKeys, tt.wantLabels)
+			}
+			if tt.wantErr && (resources != "cpu" || nodeLabels != "zone" || !slices.Equal(trackedResourceNames, []string{"cpu"})) {
+				t.Errorf("flags -r %q and -l %q tracking %q after a failed reload, want the previous ones", resources, nodeLabels, trackedResourceNames)
+			}
+			reportTestNodes(t, s, []corev1.Node{node}, trackedResourceNames)
+			series := gatherSeries(t, s, "node_resource_requests")
+			if _, ok := series[tt.wantSeries]; !ok || len(series) != 1 {
+				t.Errorf("node_resource_requests series %v, want only {%s}", series, tt.wantSeries)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	log "k8s.io/klog/v2"
+)
+
+// demoNodeCount is the number of synthetic nodes served in demo mode.
+const demoNodeCount = 8
+
+// demoAllocatable is the allocatable resources of every synthetic node.
+// Tracked resources missing here get an allocatable amount of 100.
+var demoAllocatable = corev1.ResourceList{
+	corev1.ResourceCPU:    resource.MustParse("32"),
+	corev1.ResourceMemory: resource.MustParse("128Gi"),
+	corev1.ResourcePods:   resource.MustParse("110"),
+	"nvidia.com/gpu":      resource.MustParse("8"),
+}
+
+// startDemoLoop reports random usage of synthetic nodes on every tick.
+// It never talks to the API server and is meant for building dashboards offline.
+func startDemoLoop(ctx context.Context, s *sampler) error {
+	defer log.Infof("Exited demo loop")
+	ticker := time.NewTicker(samplingInterval)
+	defer ticker.Stop()
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	created := metav1.NewTime(time.Now())
+	for {
+		select {
+		case <-ticker.C:
+			configMu.RLock()
+			nodes := demoNodes(created, trackedResourceNames, nodeLabelKeys)
+			s.reportNodes(nodes, demoUsages(rnd, nodes), trackedResourceNames, newClusterUsage())
+			configMu.RUnlock()
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func demoNodes(created metav1.Time, resources, nodeLabelNames []string) []corev1.Node {
+	nodes := make([]corev1.Node, demoNodeCount)
+	for i := range nodes {
+		allocatable := demoAllocatable.DeepCopy()
+		for _, name := range resources {
+			if _, ok := allocatable[corev1.ResourceName(name)]; !ok && name != autoDiscoverResources {
+				allocatable[corev1.ResourceName(name)] = resource.MustParse("100")
+			}
+		}
+		labels := make(map[string]string, len(nodeLabelNames))
+		for _, name := range nodeLabelNames {
+			labels[name] = fmt.Sprintf("demo-%d", i%2)
+		}
+		nodes[i] = corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              fmt.Sprintf("demo-node-%d", i),
+				Labels:            labels,
+				CreationTimestamp: created,
+			},
+			Status: corev1.NodeStatus{
+				Capacity:    allocatable,
+				Allocatable: allocatable,
+				Conditions: []corev1.NodeCondition{
+					{Type: corev1.NodeReady, Status: corev1.ConditionTrue, LastTransitionTime: created},
+				},
+				NodeInfo: corev1.NodeSystemInfo{
+					OperatingSystem: "linux",
+					Architecture:    "amd64",
+					KubeletVersion:  "v1.32.0",
+				},
+			},
+		}
+	}
+	return nodes
+}
+
+// demoUsages returns requests of a random fraction of each allocatable
+// resource, and limits of up to twice as much.
+func demoUsages(rnd *rand.Rand, nodes []corev1.Node) []*nodeUsage {
+	usages := make([]*nodeUsage, len(nodes))
+	for i := range nodes {
+		usage := newNodeUsage(nil)
+		for name, allocatable := range nodes[i].Status.Allocatable {
+			fraction := rnd.Float64()
+			milli := float64(allocatable.MilliValue())
+			usage.requests[name] = *resource.NewMilliQuantity(int64(milli*fraction), allocatable.Format)
+			usage.limits[name] = *resource.NewMilliQuantity(int64(milli*fraction*(1+rnd.Float64())), allocatable.Format)
+			usage.maxContainerRequests[name] = *resource.NewMilliQuantity(int64(milli*fraction/4), allocatable.Format)
+			usage.maxPodRequests[name] = *resource.NewMilliQuantity(int64(milli*fraction/2), allocatable.Format)
+			usage.containerRequests[name] = usage.requests[name]
+		}
+		usage.phases[corev1.PodRunning] = rnd.Intn(50)
+		usage.containers = usage.phases[corev1.PodRunning] * (1 + rnd.Intn(3))
+		usage.restarts = rnd.Intn(1 + usage.containers/10)
+		usage.accountedPods = usage.phases[corev1.PodRunning]
+		for name := range nodes[i].Status.Allocatable {
+			usage.resourcePods[string(name)] = usage.accountedPods - rnd.Intn(1+usage.accountedPods/10)
+		}
+		usages[i] = usage
+	}
+	return usages
+}
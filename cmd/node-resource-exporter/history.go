@@ -0,0 +1,117 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	log "k8s.io/klog/v2"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// nodeHistory holds the values reported for a node on the previous sampling pass.
+type nodeHistory struct {
+	requests  map[string]float64
+	occupancy map[string]float64
+	idle      bool
+	// labels holds whether the node has each of the -l node labels, and
+	// labelValues the node label values of its series
+	labels      map[string]bool
+	labelValues []string
+	// allocatable holds the allocatable amount of the resources, and
+	// allocatableChanges the number of its changes since the node was seen
+	allocatable        map[string]float64
+	allocatableChanges map[string]float64
+	// ewma holds the moving average of the occupancy of the resources
+	ewma map[string]ewmaSample
+}
+
+type ewmaSample struct {
+	value float64
+	at    time.Time
+}
+
+func newNodeHistory() *nodeHistory {
+	return &nodeHistory{
+		requests:           make(map[string]float64),
+		labels:             make(map[string]bool),
+		occupancy:          make(map[string]float64),
+		allocatable:        make(map[string]float64),
+		allocatableChanges: make(map[string]float64),
+		ewma:               make(map[string]ewmaSample),
+	}
+}
+
+// updateEWMA records and returns the moving average of the occupancy of the
+// node resource. The previous average decays by half every halfLife since it
+// was sampled, whatever the sampling interval, and starts at the occupancy.
+func (h *nodeHistory) updateEWMA(prev *nodeHistory, resource string, occupancy float64, now time.Time, halfLife time.Duration) float64 {
+	value := occupancy
+	if prev != nil {
+		if last, ok := prev.ewma[resource]; ok {
+			decay := math.Exp2(-now.Sub(last.at).Seconds() / halfLife.Seconds())
+			value = decay*last.value + (1-decay)*occupancy
+		}
+	}
+	h.ewma[resource] = ewmaSample{value: value, at: now}
+	return value
+}
+
+// countAllocatableChanges records the allocatable amount of the node
+// resource and returns the number of its changes, counting a new change if
+// it differs from the previous pass, or appeared or disappeared since.
+func (h *nodeHistory) countAllocatableChanges(prev *nodeHistory, node *corev1.Node, resource string) float64 {
+	v, ok := node.Status.Allocatable[corev1.ResourceName(resource)]
+	value := quantityValue(resource, v)
+	if ok {
+		h.allocatable[resource] = value
+	}
+	if prev == nil {
+		return 0
+	}
+	changes := prev.allocatableChanges[resource]
+	if prevValue, prevOK := prev.allocatable[resource]; ok != prevOK || value != prevValue {
+		log.Infof("Allocatable %s of node %s changed from %v to %v", resource, node.Name, prevValue, value)
+		changes++
+	}
+	h.allocatableChanges[resource] = changes
+	return changes
+}
+
+// detectLabelDrift records which of the -l node labels the node has and
+// counts those appearing or disappearing since the previous pass, whose
+// series then move to another label value. Labels newly passed onto the
+// metrics have no previous state to drift from.
+func (s *sampler) detectLabelDrift(prev, curr *nodeHistory, node *corev1.Node) {
+	for _, key := range nodeLabelKeys {
+		_, ok := node.Labels[key]
+		curr.labels[key] = ok
+		if prev == nil {
+			continue
+		}
+		if prevOK, tracked := prev.labels[key]; tracked && ok != prevOK {
+			log.Infof("Label %s of node %s changed from present %v to %v", key, node.Name, prevOK, ok)
+			s.metric.LabelDrift.WithLabelValues(key).Inc()
+		}
+	}
+}
+
+// pruneHistories forgets the nodes not seen in the current sampling pass.
+func (s *sampler) pruneHistories(seen map[string]bool) {
+	for name := range s.histories {
+		if !seen[name] {
+			delete(s.histories, name)
+			if summary := s.metric.NodeResourceOccupancySummary; summary != nil {
+				summary.DeletePartialMatch(prometheus.Labels{nodeLabelKey: name})
+			}
+		}
+	}
+	for _, held := range s.heldUsages {
+		for name := range held {
+			if !seen[name] {
+				delete(held, name)
+			}
+		}
+	}
+}
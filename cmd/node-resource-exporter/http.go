@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "k8s.io/klog/v2"
+
+	"github.com/dmitsh/node-resource-exporter/pkg/metrics"
+)
+
+// newHandlerInstrumenter registers the request duration histogram of the HTTP
+// endpoints, and returns a function wrapping the handler of an endpoint with it.
+// A scrape slowing down with the number of series shows up on the metrics path.
+func newHandlerInstrumenter(reg prometheus.Registerer) func(handler string, next http.Handler) http.Handler {
+	duration := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "node_resource_exporter_http_request_duration_seconds",
+			Help:    "Duration of the HTTP requests served by the exporter, by handler, method and status code.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"handler", "method", "code"})
+	reg.MustRegister(duration)
+	return func(handler string, next http.Handler) http.Handler {
+		return promhttp.InstrumentHandlerDuration(duration.MustCurryWith(prometheus.Labels{"handler": handler}), next)
+	}
+}
+
+// shuttingDown is set once the servers start shutting down.
+var shuttingDown atomic.Bool
+
+// rejectWhenShuttingDown answers the requests arriving on kept-alive
+// connections during shutdown with a 503 closing the connection, so that
+// Prometheus records a clean scrape failure rather than a connection reset.
+// The in-flight requests complete normally.
+func rejectWhenShuttingDown(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if shuttingDown.Load() {
+			w.Header().Set("Connection", "close")
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireAdmin guards admin endpoints with the bearer token set by -admin-token.
+// Admin endpoints are disabled when no token is configured.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(adminToken) == 0 {
+			http.Error(w, "admin endpoints are disabled, set -admin-token to enable them", http.StatusForbidden)
+			return
+		}
+		expected := "Bearer " + adminToken
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleLogLevel changes the klog verbosity level, e.g. PUT /loglevel?v=4.
+func handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query().Get("v")
+	if len(v) == 0 {
+		http.Error(w, "missing 'v' query parameter", http.StatusBadRequest)
+		return
+	}
+
+	var level log.Level
+	if err := level.Set(v); err != nil {
+		http.Error(w, fmt.Sprintf("invalid verbosity %q: %v", v, err), http.StatusBadRequest)
+		return
+	}
+	log.Infof("Log verbosity set to %s", v)
+	fmt.Fprintf(w, "verbosity set to %s\n", v)
+}
+
+// handleSample runs a sampling pass of each cluster, or of the one of the
+// 'cluster' query parameter, e.g. POST /sample, and returns once done. It
+// fails with 409 if a pass is in progress. It is meant for debugging.
+func handleSample(samplers []*sampler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cluster := r.URL.Query().Get("cluster")
+		found := false
+		for _, s := range samplers {
+			if len(cluster) != 0 && s.cluster != cluster {
+				continue
+			}
+			found = true
+			n, err := s.reportResourceUsage(r.Context())
+			if errors.Is(err, errPassInProgress) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("sampling failed: %v", err), http.StatusInternalServerError)
+				return
+			}
+			log.Infof("Sampled %d nodes%s on request", n, s.clusterSuffix())
+			fmt.Fprintf(w, "sampled %d nodes%s\n", n, s.clusterSuffix())
+		}
+		if !found {
+			http.Error(w, fmt.Sprintf("unknown cluster %q", cluster), http.StatusNotFound)
+		}
+	}
+}
+
+// sampled is set once the first sampling pass has completed.
+var sampled atomic.Bool
+
+// handleHealthz reports the liveness of the exporter, failing if the sampling
+// loop is stuck. Failing passes leave it live, the time since the last
+// successful one being reported for information.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if since, stuck := samplingStuck(); stuck {
+		http.Error(w, fmt.Sprintf("no sampling pass ended for %v", since.Round(time.Second)), http.StatusServiceUnavailable)
+		return
+	}
+	if !sampled.Load() {
+		fmt.Fprintln(w, "ok, no successful sample yet")
+		return
+	}
+	fmt.Fprintf(w, "ok, last successful sample %v ago\n", sinceLastSample().Round(time.Second))
+}
+
+// handleReadyz returns a readiness handler failing until the first sampling
+// pass has completed, or the -warmup period since start has elapsed.
+func handleReadyz(start time.Time) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !sampled.Load() && (warmup <= 0 || time.Since(start) < warmup) {
+			http.Error(w, "waiting for the first sample", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// secretFlags are the flags whose values /config redacts.
+var secretFlags = map[string]bool{
+	"admin-token": true,
+}
+
+// handleConfig serves the flags and the configuration resolved from them as
+// JSON, e.g. GET /config. It is meant for debugging deployments, and guarded
+// like the other admin endpoints as it discloses the paths and endpoints.
+func handleConfig(w http.ResponseWriter, r *http.Request) {
+	flags := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if secretFlags[f.Name] && len(value) != 0 {
+			value = "REDACTED"
+		}
+		flags[f.Name] = value
+	})
+
+	configMu.RLock()
+	config := struct {
+		Flags            map[string]string `json:"flags"`
+		Resources        []string          `json:"resources"`
+		NodeLabels       []string          `json:"nodeLabels"`
+		SamplingInterval string            `json:"samplingInterval"`
+	}{
+		Flags:            flags,
+		Resources:        trackedResourceNames,
+		NodeLabels:       nodeLabelNames(),
+		SamplingInterval: samplingInterval.String(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(config)
+	configMu.RUnlock()
+	if err != nil {
+		log.Infof("ERROR: failed to write the config: %v", err)
+	}
+}
+
+// handleNodeMetrics serves the series of a single node, e.g. GET /node/worker-1/metrics,
+// of all the clusters. It is meant for interactive debugging.
+func handleNodeMetrics(g prometheus.Gatherer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		promhttp.HandlerFor(metrics.NodeGatherer(g, nodeLabelKey, r.PathValue("name")), promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAdminConfig(t *testing.T) {
+	tests := []struct {
+		name          string
+		token         string
+		authorization string
+		want          int
+	}{
+		{name: "without -admin-token", want: http.StatusForbidden},
+		{name: "without a token", token: "secret", want: http.StatusUnauthorized},
+		{name: "wrong token", token: "secret", authorization: "Bearer other", want: http.StatusUnauthorized},
+		{name: "admin token", token: "secret", authorization: "Bearer secret", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, &adminToken, tt.token)
+			r := httptest.NewRequest(http.MethodGet, "/config", nil)
+			if len(tt.authorization) != 0 {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			requireAdmin(handleConfig)(w, r)
+			if w.Code != tt.want {
+				t.Errorf("GET /config status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestRejectWhenShuttingDown(t *testing.T) {
+	t.Cleanup(func() { shuttingDown.Store(false) })
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, down := range []bool{false, true} {
+		shuttingDown.Store(down)
+		w := httptest.NewRecorder()
+		rejectWhenShuttingDown(ok).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		want, wantConnection := http.StatusOK, ""
+		if down {
+			want, wantConnection = http.StatusServiceUnavailable, "close"
+		}
+		if w.Code != want {
+			t.Errorf("shutting down %v: status %d, want %d", down, w.Code, want)
+		}
+		if got := w.Header().Get("Connection"); got != wantConnection {
+			t.Errorf("shutting down %v: Connection header %q, want %q", down, got, wantConnection)
+		}
+	}
+}
+
+func TestRejectWhenShuttingDownInFlight(t *testing.T) {
+	t.Cleanup(func() { shuttingDown.Store(false) })
+	entered, release := make(chan struct{}), make(chan struct{})
+	server := httptest.NewServer(rejectWhenShuttingDown(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+	})))
+	defer server.Close()
+
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	<-entered
+	shuttingDown.Store(true)
+	close(release)
+	if got := <-status; got != http.StatusOK {
+		t.Errorf("in-flight request status %d, want %d", got, http.StatusOK)
+	}
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("request during shutdown: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("request during shutdown status %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+}
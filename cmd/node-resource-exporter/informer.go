@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	log "k8s.io/klog/v2"
+)
+
+// newPodInformerFactory returns the informer factory caching the pods listed
+// by podListOptions, and sets the pod lister of the sampler. Watch errors are
+// counted before the reflector relists the pods with exponential backoff.
+func (s *sampler) newPodInformerFactory() (informers.SharedInformerFactory, error) {
+	factory := informers.NewSharedInformerFactoryWithOptions(s.kubeClient, resyncPeriod,
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = podListOptions("").FieldSelector
+		}))
+	podInformer := factory.Core().V1().Pods()
+	informer := podInformer.Informer()
+	s.podWatch = &watchHealth{synced: informer.HasSynced}
+	if err := informer.SetWatchErrorHandler(func(r *cache.Reflector, err error) {
+		s.metric.InformerResets.Inc()
+		s.podWatch.watchError()
+		cache.DefaultWatchErrorHandler(r, err)
+	}); err != nil {
+		return nil, err
+	}
+	if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(any) { s.podWatch.event() },
+		UpdateFunc: func(any, any) { s.podWatch.event() },
+		DeleteFunc: func(any) { s.podWatch.event() },
+	}); err != nil {
+		return nil, err
+	}
+	s.podLister = podInformer.Lister()
+	s.podListerSynced = informer.HasSynced
+	return factory, nil
+}
+
+// watchHealth tells whether an informer keeps up with the API server, which
+// HasSynced alone does not: it stays true once the initial list is synced.
+// After a watch error the reflector relists the objects, each delivered to
+// the event handlers, so an event following the error shows the relist
+// succeeded. An informer of no objects at all stays stale until one appears.
+type watchHealth struct {
+	synced cache.InformerSynced
+	// lastError and lastEvent hold the times in Unix nanoseconds of the last
+	// watch error and of the last event
+	lastError atomic.Int64
+	lastEvent atomic.Int64
+}
+
+func (h *watchHealth) watchError() {
+	h.lastError.Store(time.Now().UnixNano())
+}
+
+func (h *watchHealth) event() {
+	h.lastEvent.Store(time.Now().UnixNano())
+}
+
+// connected reports whether the cache is synced and no watch error occurred
+// since the last event.
+func (h *watchHealth) connected() bool {
+	return h.synced() && h.lastEvent.Load() >= h.lastError.Load()
+}
+
+// startInformers runs the informers of the factory until the context is canceled.
+func startInformers(ctx context.Context, factory informers.SharedInformerFactory) error {
+	defer log.Infof("Exited informers")
+	factory.Start(ctx.Done())
+	<-ctx.Done()
+	factory.Shutdown()
+	return ctx.Err()
+}
+
+func listNodeUsageInformer(podLister corelisters.PodLister, podListerSynced cache.InformerSynced, nodes []corev1.Node, podUsage podUsageIndex) []*nodeUsage {
+	usages := make([]*nodeUsage, len(nodes))
+	if !podListerSynced() {
+		log.Infof("ERROR: the pod cache is not synced yet")
+		return usages
+	}
+
+	pods, err := podLister.List(labels.Everything())
+	if err != nil {
+		log.Infof("ERROR: failed to list the cached pods: %v", err)
+		return usages
+	}
+
+	byNode := make(map[string]*nodeUsage, len(nodes))
+	for i := range nodes {
+		usages[i] = newNodeUsage(podUsage)
+		byNode[nodes[i].Name] = usages[i]
+	}
+	for _, pod := range pods {
+		if usage, ok := byNode[pod.Spec.NodeName]; ok {
+			usage.addPod(pod)
+		}
+	}
+
+	return usages
+}
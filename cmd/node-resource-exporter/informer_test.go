@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestWatchHealthConnected(t *testing.T) {
+	tests := []struct {
+		name      string
+		synced    bool
+		lastError int64
+		lastEvent int64
+		want      bool
+	}{
+		{name: "not synced", synced: false, want: false},
+		{name: "synced without watch error", synced: true, lastEvent: 1, want: true},
+		{name: "synced without objects", synced: true, want: true},
+		{name: "watch error after the last event", synced: true, lastError: 2, lastEvent: 1, want: false},
+		{name: "relisted after the watch error", synced: true, lastError: 2, lastEvent: 3, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &watchHealth{synced: func() bool { return tt.synced }}
+			h.lastError.Store(tt.lastError)
+			h.lastEvent.Store(tt.lastEvent)
+			if got := h.connected(); got != tt.want {
+				t.Errorf("connected %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
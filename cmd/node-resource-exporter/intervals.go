@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// parseResourceIntervals parses the -resource-intervals pairs. The intervals
+// cannot be shorter than the sampling interval, which paces the passes.
+func parseResourceIntervals(value string) (map[string]time.Duration, error) {
+	intervals := make(map[string]time.Duration)
+	for _, pair := range parseList(value, "-resource-intervals") {
+		resource, duration, ok := strings.Cut(pair, "=")
+		if !ok || len(resource) == 0 {
+			return nil, fmt.Errorf("invalid resource interval %q, expected resource=duration", pair)
+		}
+		interval, err := time.ParseDuration(duration)
+		if err != nil || interval < samplingInterval {
+			return nil, fmt.Errorf("invalid resource interval %q, expected a duration of at least %v", pair, samplingInterval)
+		}
+		intervals[resource] = interval
+	}
+	return intervals, nil
+}
+
+// isResourceDue reports whether a pass at the given time samples the
+// resource: its -resource-intervals interval elapsed since the last pass
+// sampling it, within half a sampling interval to absorb the ticker jitter.
+func (s *sampler) isResourceDue(resource string, now time.Time) bool {
+	interval, ok := resourceIntervals[resource]
+	if !ok {
+		return true
+	}
+	last, ok := s.resourceSampled[resource]
+	return !ok || now.Sub(last) >= interval-samplingInterval/2
+}
+
+// isPassDue reports whether a pass at the given time samples any of the
+// tracked resources. Auto-discovered resources are always sampled.
+func (s *sampler) isPassDue(now time.Time) bool {
+	if len(resourceIntervals) == 0 || (len(trackedResourceNames) == 1 && trackedResourceNames[0] == autoDiscoverResources) {
+		return true
+	}
+	for _, resource := range trackedResourceNames {
+		if !excludedResources[resource] && s.isResourceDue(resource, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// resourceUsage returns the usage of the node the resource is reported
+// from: that of the pass if the resource is due, or that of the last pass
+// sampling it otherwise, so that it keeps its values until its next one.
+func (s *sampler) resourceUsage(resource, nodeName string, usage *nodeUsage, now time.Time) *nodeUsage {
+	if _, ok := resourceIntervals[resource]; !ok {
+		return usage
+	}
+	held := s.heldUsages[resource]
+	if held == nil {
+		held = make(map[string]*nodeUsage)
+		s.heldUsages[resource] = held
+	}
+	if prev, ok := held[nodeName]; ok && !s.isResourceDue(resource, now) {
+		return prev
+	}
+	held[nodeName] = usage
+	return usage
+}
+
+// markResourcesSampled records the pass at the given time as the last one of
+// the resources it sampled.
+func (s *sampler) markResourcesSampled(now time.Time) {
+	for resource := range resourceIntervals {
+		if s.isResourceDue(resource, now) {
+			s.resourceSampled[resource] = now
+		}
+	}
+}
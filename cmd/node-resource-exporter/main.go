@@ -2,64 +2,654 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"path"
+	"regexp"
+	"slices"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/oklog/run"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/client-go/rest"
 	log "k8s.io/klog/v2"
 
 	"github.com/dmitsh/node-resource-exporter/pkg/metrics"
 )
 
+// labelNameRE matches the valid Prometheus label names.
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// samplingInterval is the interval between two sampling passes.
+const samplingInterval = 10 * time.Second
+
+// maxDefaultConcurrency bounds the number of concurrent pod list calls
+// when -concurrency is not set explicitly.
+const maxDefaultConcurrency = 16
+
+// Node labels modes.
+const (
+	labelsSeparate = "separate"
+	labelsJoined   = "joined"
+
+	// joinedLabelName is the metric label holding the node labels in joined mode
+	joinedLabelName = "node_labels"
+)
+
+// Pod list strategies.
+const (
+	listPerNode  = "per-node"
+	listSingle   = "single"
+	listInformer = "informer"
+)
+
 var (
-	port                  int
+	port, concurrency     int
+	watchdogIntervals     int
+	roundDigits           int
+	cpuOccupancyDigits    int
+	shard, shardTotal     int
 	nodeLabels, resources string
-	resourceScores        metrics.ResourceScore
+	listStrategy          string
+	listPageSize          int
+	limitsAggregation     string
+	labelsMode            string
+	nodeLabelKey          string
+	metricsPath           string
+	occupancyBasis        string
+	cpuUnit               string
+	otlpEndpoint          string
+	outputFile            string
+	kubeQPS               float64
+	kubeBurst             int
+	failFast              bool
+	adminListen           string
+	headroomFraction      float64
+	maxLabelLength        int
+	configFile            string
+	occupancyFrom         string
+	maxNodes              int
+	excludeControlPlane   bool
+	nativeHistograms      bool
+	includeArchOS         bool
+	controlPlaneLabel     string
+	poolLabel             string
+	instanceTypeLabel     string
+	zoneLabel             string
+	resyncPeriod          time.Duration
+	readyOnly             bool
+	weightedOccupancy     bool
+	clampOccupancy        bool
+	emitQuantityInfo      bool
+	otlpInsecure          bool
+	adminToken            string
+	tlsCertFile           string
+	tlsKeyFile            string
+	scrapeTimeCollection  bool
+	podUsage              bool
+	omitZero              bool
+	initZeroSeries        bool
+	demo                  bool
+	watchdogExit          bool
+	podPhaseMetrics       bool
+
+	allocatableFallbackCapacity bool
+	reservedIncludesPending     bool
+	schedulerAccurate           bool
+	countAllContainers          bool
+	requestsByOwner             bool
+	requestsByPriority          bool
+	resourceQuotas              bool
+	resourceClaims              bool
+	excludeTerminating          bool
+	includeStaticPods           bool
+	useAllocatedResources       bool
+	occupancyQuantileWindow     int
+	occupancyQuantilesStr       string
+	occupancyQuantiles          []float64
+	occupancySummaryWindow      time.Duration
+	summaryObjectivesStr        string
+	occupancySummaryObjectives  []float64
+	defaultRequestToLimit       bool
+	effectiveLimits             bool
+	clampRequestsToLimits       bool
+	scrapeCacheTTL              time.Duration
+	warmup                      time.Duration
+	warmupSamples               int
+	warmupSampleSpacing         time.Duration
+	scoreTTL                    time.Duration
+	staleTTL                    time.Duration
+	staleGracePeriod            time.Duration
+	shutdownTimeout             time.Duration
+	tickTimeout                 time.Duration
+	occupancyAlertDelta         float64
+	occupancyEWMAHalfLife       time.Duration
+	excludeResources            string
+	excludedResources           map[string]bool
+	podFieldSelectorStr         string
+	qosFilter                   string
+	resourceAliasesStr          string
+	resourceAliases             map[string]string
+	resourceScalesStr           string
+	unitConversionsStr          string
+	resourceIntervalsStr        string
+	resourceIntervals           map[string]time.Duration
+	occupancyCriticalStr        string
+	occupancyBasesStr           string
+	occupancyBases              map[string]string
+	scoreExprStr                string
+	labelValueAllowlistStr      string
+	nodeNamesStr                string
+	nodeNames                   map[string]bool
+	labelValueAllowlist         map[string]map[string]bool
+	scoreExpr                   *metrics.ScoreExpr
+	occupancyCritical           map[string]float64
+	resourceScales              map[string]float64
+	resourceUnits               string
+	kubeconfigsStr              string
+	qosClasses                  map[corev1.PodQOSClass]bool
+	excludeContainerNamesStr    string
+	excludedContainerNames      []string
+	podFieldSelector            = fields.Everything()
+	nodeLabelKeys               []string
+	trackedResourceNames        []string
 )
 
 func main() {
 	flag.IntVar(&port, "p", 8080, "Prometheus target port")
-	flag.StringVar(&resources, "r", "", "Comma-separated list of tracked resource names")
+	flag.StringVar(&metricsPath, "metrics-path", "/metrics", "HTTP path of the Prometheus metrics")
+	flag.StringVar(&resources, "r", "", "Comma-separated list of tracked resource names, or '*' to track all allocatable resources")
+	flag.StringVar(&resourceUnits, "resource-units", "", "Comma-separated list of resource=unit pairs documented in the metrics help, in addition to the cpu, memory and storage defaults")
+	flag.StringVar(&resourceIntervalsStr, "resource-intervals", "", "Comma-separated list of resource=duration pairs sampling the slow-changing resources less often than every sampling interval, e.g. 'nvidia.com/gpu=60s'; the resources keep their values in between")
+	flag.StringVar(&unitConversionsStr, "units", "", "Comma-separated list of resource=unit pairs converting the reported amounts of the resources, the unit being KB, MB, GB, TB, KiB, MiB, GiB, TiB or a divisor, e.g. 'memory=GiB' or 'memory=1073741824'; the unit is documented in the metrics help")
+	flag.StringVar(&resourceScalesStr, "resource-scale", "", "Comma-separated list of resource=factor pairs multiplying the reported amounts of the resources, e.g. 'nvidia.com/gpu.memory=1048576' to report MiB in bytes")
+	flag.StringVar(&resourceAliasesStr, "resource-aliases", "", "Comma-separated list of resource=alias pairs renaming the resource label of the metrics, e.g. 'memory=mem'; an alias may not be the name of another resource")
+	flag.StringVar(&excludeContainerNamesStr, "exclude-container-names", "", "Comma-separated list of glob patterns of the names of the containers, e.g. sidecars like 'istio-proxy', left out of the requests and limits and reported by node_resource_requests_sidecar")
+	flag.StringVar(&excludeResources, "exclude-resources", "", "Comma-separated list of resource names not to track")
 	flag.StringVar(&nodeLabels, "l", "", "Comma-separated list of node label names to be passed onto metrics")
+	flag.IntVar(&maxLabelLength, "max-label-length", 0, "Maximum length of the node label values passed onto metrics, longer ones being truncated (0 for no limit)")
+	flag.StringVar(&labelValueAllowlistStr, "label-value-allowlist", "", "Comma-separated list of label=value pairs allowed for the node labels passed onto metrics, other values of the listed labels being reported as 'other', e.g. 'zone=east,zone=west'")
+	flag.StringVar(&nodeLabelKey, "node-label-key", "node", "Name of the label of the node name in the metrics, e.g. to avoid collisions with other exporters")
+	flag.StringVar(&labelsMode, "labels-mode", labelsSeparate, "How node labels are passed onto metrics: 'separate' labels, or 'joined' into a single node_labels label of k=v pairs")
+	flag.IntVar(&concurrency, "concurrency", 0, "Maximum number of nodes whose pods are listed concurrently (0 derives it from the node count)")
+	flag.StringVar(&adminListen, "admin-listen", "", "Address (e.g. 127.0.0.1:9091) of a separate listener for the admin and debug endpoints, which are otherwise served on the metrics port")
+	flag.BoolVar(&failFast, "fail-fast", false, "Exit if the first sampling pass fails or finds no nodes")
+	flag.StringVar(&kubeconfigsStr, "kubeconfigs", "", "Comma-separated list of path[:context] kubeconfig entries of the clusters to sample, each series getting a cluster label named after the context or the file (in-cluster config if empty)")
+	flag.Float64Var(&kubeQPS, "kube-qps", 5, "Maximum QPS towards the Kubernetes API server, raise it (e.g. 50) on large clusters with -list-strategy=per-node")
+	flag.IntVar(&kubeBurst, "kube-burst", 10, "Maximum burst towards the Kubernetes API server, raise it (e.g. 100) along with -kube-qps")
+	flag.StringVar(&outputFile, "output-file", "", "File the metrics are written to in the Prometheus text format every sampling interval, in addition to serving them, e.g. to ship them from air-gapped clusters")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "", "OTLP gRPC endpoint (host:port) to push the metrics to, in addition to serving them to Prometheus")
+	flag.BoolVar(&otlpInsecure, "otlp-insecure", false, "Disable TLS towards the OTLP endpoint")
+	flag.StringVar(&cpuUnit, "cpu-unit", cpuCores, "Unit of the cpu amounts: 'cores' or 'millicores'")
+	flag.StringVar(&configFile, "config-file", "", "File of name=value lines setting the r, l and exclude-resources flags, reloaded on SIGHUP")
+	flag.Float64Var(&headroomFraction, "headroom-fraction", 0, "Fraction of the occupancy basis kept as headroom: occupancy is computed against basis*(1-fraction) and exceeds 100% once the headroom is used")
+	flag.BoolVar(&weightedOccupancy, "weighted-occupancy", false, "Report node_resource_weighted_occupancy, weighting the requests of the pods by their priority")
+	flag.BoolVar(&clampOccupancy, "clamp-occupancy", false, "Cap the occupancy of overcommitted nodes at 100%")
+	flag.BoolVar(&readyOnly, "ready-only", false, "Report the occupancy and score of Ready nodes only")
+	flag.StringVar(&limitsAggregation, "limits-aggregation", limitsSum, "Aggregation of the container limits of a pod: 'sum' of the containers as accounted by the kubelet, or 'max' for the highest limit of any one container")
+	flag.StringVar(&occupancyFrom, "occupancy-from", occupancyFromRequests, "Numerator of the occupancy and score: 'requests' or 'limits'")
+	flag.StringVar(&occupancyBasis, "occupancy-basis", basisAllocatable, "Denominator of the occupancy: 'allocatable' or 'capacity'")
+	flag.StringVar(&occupancyBasesStr, "occupancy-basis-per-resource", "", "Comma-separated list of resource=basis pairs overriding -occupancy-basis for the resource, e.g. 'ephemeral-storage=capacity'")
+	flag.BoolVar(&useAllocatedResources, "use-allocated-resources", false, "Account for the container resources reported in the pod status, which differ from the spec while an in-place resize is in progress; requires the InPlacePodVerticalScaling feature")
+	flag.BoolVar(&includeStaticPods, "include-static-pods", false, "Account for the static pods run by the kubelet regardless of -pod-field-selector and -qos-filter, which then only apply to the other pods; the field selector is matched by the exporter rather than the API server")
+	flag.BoolVar(&excludeTerminating, "exclude-terminating", false, "Leave the pods being deleted out of the requests and limits, although still running through their termination grace period")
+	flag.BoolVar(&effectiveLimits, "effective-limits", false, "Count the node allocatable as the cpu, memory and ephemeral-storage limit of the pods with a container setting no limit, as they may use the whole node")
+	flag.BoolVar(&defaultRequestToLimit, "default-request-to-limit", false, "Default the unset requests of the containers to their limits, as the API server does on pod creation")
+	flag.BoolVar(&clampRequestsToLimits, "clamp-requests-to-limits", false, "Cap the requests of each container resource at its limit, if set, to account for the enforceable usage of misconfigured containers")
+	flag.BoolVar(&schedulerAccurate, "scheduler-accurate", false, "Account for the pods as the scheduler does: all pods bound to a node but the succeeded and failed ones, the pending ones adding their requests only")
+	flag.BoolVar(&reservedIncludesPending, "reserved-includes-pending", false, "Add the requests of the pending pods bound to a node to its requests, as reserved by the scheduler, but not to its limits")
+	flag.BoolVar(&countAllContainers, "count-all-containers", false, "Count the init and ephemeral containers of the running pods in node_container_count, in addition to the regular ones")
+	flag.BoolVar(&podPhaseMetrics, "pod-phase-metrics", true, "Report node_pod_phase_count, which requires listing the pods of all phases; disable it to have the API server filter the pod lists by phase, e.g. 'status.phase=Running', cutting their payload on nodes with many completed pods")
+	flag.BoolVar(&resourceQuotas, "resource-quotas", false, "Report namespace_resource_quota_used and namespace_resource_quota_hard from the ResourceQuotas of all namespaces")
+	flag.BoolVar(&resourceClaims, "resource-claims", false, "Report node_resource_claims with the devices allocated to the ResourceClaims of the pods, by driver, which requires the resource.k8s.io/v1beta1 API of Dynamic Resource Allocation")
+	flag.BoolVar(&requestsByPriority, "requests-by-priority", false, "Report node_resource_requests_by_priority with the requests of the pods of each priority class, one series per priority class and node")
+	flag.BoolVar(&requestsByOwner, "requests-by-owner", false, "Report node_resource_requests_by_owner with the requests of each Deployment, StatefulSet, DaemonSet or other top-level controller, one series per controller and node")
+	flag.BoolVar(&emitQuantityInfo, "emit-quantity-info", false, "Report node_resource_requests_quantity with the exact requests quantity as a label, one series per distinct value")
+	flag.StringVar(&occupancyCriticalStr, "occupancy-critical", "", "Comma-separated list of resource=percent occupancy thresholds, or a percent applying to the other resources, above which node_resource_overloaded is 1, e.g. '90,nvidia.com/gpu=100'")
+	flag.IntVar(&occupancyQuantileWindow, "occupancy-quantile-window", 0, "Number of sampling passes over which cluster_resource_occupancy_quantile reports the quantiles of the node occupancies (0 disables)")
+	flag.DurationVar(&occupancySummaryWindow, "occupancy-summary-window", 0, "Time window of node_resource_occupancy_summary, the quantiles of the occupancy of each node resource over time, adding a series per objective (0 disables)")
+	flag.StringVar(&summaryObjectivesStr, "occupancy-summary-objectives", "0.5,0.9,0.99", "Comma-separated list of the quantiles reported by node_resource_occupancy_summary")
+	flag.StringVar(&occupancyQuantilesStr, "occupancy-quantiles", "0.5,0.9,0.99", "Comma-separated list of the quantiles reported by cluster_resource_occupancy_quantile")
+	flag.BoolVar(&omitZero, "omit-zero", false, "Do not report zero resource requests and limits")
+	flag.BoolVar(&initZeroSeries, "init-zero-series", false, "Report the requests, limits, occupancy, allocatable and available amounts of every node and tracked resource, 0 when unknown, e.g. if the pods of the node could not be listed or the resource is not allocatable on the node")
+	flag.DurationVar(&occupancyEWMAHalfLife, "occupancy-ewma-half-life", 0, "Half-life of node_resource_occupancy_ewma, the moving average of the occupancy (0 disables)")
+	flag.Float64Var(&occupancyAlertDelta, "occupancy-alert-delta", 0, "Log occupancy changes between two samples larger than this many percentage points (0 disables)")
+	flag.BoolVar(&allocatableFallbackCapacity, "allocatable-fallback-capacity", false, "Compute the occupancy against capacity for resources missing from allocatable")
+	flag.IntVar(&roundDigits, "round-digits", -1, "Number of decimal places to round occupancy, score and ratio values to (negative disables rounding)")
+	flag.StringVar(&scoreExprStr, "score-expr", "", "Expression computing the score from the occupancy percentage 'occ', the default score 'avg', the previous score 'prev' and the resource name 'resource', e.g. 'ema(occ, 0.3)' (the default score if empty)")
+	flag.IntVar(&cpuOccupancyDigits, "cpu-occupancy-digits", -1, "Number of decimal places to round the cpu occupancy to, dropping the float noise of cpu amounts, e.g. 6 to report 300m of 1 cpu as 30 rather than 30.000000000000004 (negative disables rounding)")
+	flag.DurationVar(&staleTTL, "stale-ttl", 0, "Time after which the metrics of the last sampling pass are dropped while the nodes cannot be listed, node_resource_stale being 1 meanwhile (0 keeps them forever)")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 10*time.Second, "Time to wait on shutdown for the in-flight requests, such as scrapes, to complete")
+	flag.DurationVar(&tickTimeout, "tick-timeout", 0, "Deadline of each sampling pass of the ticker, aborted when exceeded, e.g. '8s'. 0 disables it")
+	flag.DurationVar(&staleGracePeriod, "stale-grace-period", 0, "Time during which a node missing from the node list keeps being reported with its last listed state, so that brief gaps do not delete its series (0 deletes them at once)")
+	flag.DurationVar(&scoreTTL, "score-ttl", 0, "Time after which the samples of a node no longer sampled, e.g. drained or removed, are taken out of the score of its resources, a score no node samples anymore being reset (0 keeps them forever)")
+	flag.IntVar(&watchdogIntervals, "watchdog-intervals", 6, "Number of sampling intervals without a sampling pass ending, successfully or not, after which /healthz fails (0 disables)")
+	flag.BoolVar(&watchdogExit, "watchdog-exit", false, "Exit when /healthz fails because the sampling loop is stuck")
+	flag.StringVar(&tlsCertFile, "tls-cert-file", "", "File of the TLS certificate of the metrics and admin listeners, reloaded when it changes (plain HTTP if empty)")
+	flag.StringVar(&tlsKeyFile, "tls-key-file", "", "File of the private key of -tls-cert-file, reloaded when it changes")
+	flag.StringVar(&adminToken, "admin-token", "", "Bearer token required by the admin endpoints (admin endpoints are disabled if empty)")
+	flag.StringVar(&listStrategy, "list-strategy", listPerNode, "Pod list strategy: 'per-node' lists pods of each node separately, 'single' lists all pods at once, 'informer' watches all pods")
+	flag.IntVar(&listPageSize, "list-page-size", 0, "Number of pods per page of the 'single' list strategy, bounding the memory held by the list on large clusters (0 lists all pods in one response)")
+	flag.DurationVar(&resyncPeriod, "resync", 0, "Resync period of the pod informer with -list-strategy=informer (0 disables resyncs)")
+	flag.IntVar(&shard, "shard", 0, "Index of the node shard processed by this instance")
+	flag.StringVar(&nodeNamesStr, "nodes", "", "Comma-separated list of the names of the only nodes to process, e.g. to debug known-bad nodes (all nodes if empty)")
+	flag.BoolVar(&excludeControlPlane, "exclude-control-plane", false, "Leave out the control-plane nodes, those with the -control-plane-label")
+	flag.BoolVar(&nativeHistograms, "native-histograms", false, "Observe the running pods of each node at each sampling pass into the node_pod_density native histogram, which requires a Prometheus scraping the protobuf format")
+	flag.BoolVar(&includeArchOS, "include-arch-os", false, "Add the arch and os labels to the metrics, set from the architecture and operating system of the node info")
+	flag.StringVar(&instanceTypeLabel, "instance-type-label", corev1.LabelInstanceTypeStable, "Node label of the instance type of the nodes, reported by instancetype_resource_occupancy (empty disables)")
+	flag.StringVar(&zoneLabel, "zone-label", corev1.LabelTopologyZone, "Node label of the zone of the nodes, reported by zone_resource_occupancy_skew (empty disables)")
+	flag.StringVar(&poolLabel, "pool-label", "", "Node label grouping the nodes into pools, reported by pool_resource_occupancy_min, _max and _avg (empty disables)")
+	flag.StringVar(&controlPlaneLabel, "control-plane-label", "node-role.kubernetes.io/control-plane", "Label of the control-plane nodes left out by -exclude-control-plane, whatever its value")
+	flag.IntVar(&maxNodes, "max-nodes", 0, "Maximum number of nodes processed per sampling pass, the first ones by name (0 for no limit)")
+	flag.IntVar(&shardTotal, "shard-total", 1, "Total number of node shards, nodes are assigned to shards by hashing their names")
+	flag.StringVar(&qosFilter, "qos-filter", "", "Comma-separated list of QoS classes of the pods to account for, e.g. 'Guaranteed' (all classes if empty)")
+	flag.StringVar(&podFieldSelectorStr, "pod-field-selector", "", "Field selector restricting the listed pods, e.g. 'status.phase=Running'")
+	flag.BoolVar(&podUsage, "pod-usage", false, "Query the metrics server for pod usage")
+	flag.IntVar(&warmupSamples, "warmup-samples", 0, "Number of samples taken at startup, -warmup-sample-spacing apart, before sampling every interval")
+	flag.DurationVar(&warmupSampleSpacing, "warmup-sample-spacing", time.Second, "Time between two -warmup-samples")
+	flag.DurationVar(&warmup, "warmup", 0, "Time after which /readyz succeeds even if the first sample has not completed (0 waits for the first sample)")
+	flag.BoolVar(&demo, "demo", false, "Serve synthetic metrics of made-up nodes without connecting to a cluster")
+	flag.BoolVar(&scrapeTimeCollection, "scrape-time-collection", false, "Sample the cluster when scraped instead of on a background ticker")
+	flag.DurationVar(&scrapeCacheTTL, "scrape-cache-ttl", 5*time.Second, "Minimum time between two scrape-time samples")
 
 	log.InitFlags(nil)
 	flag.Parse()
 
-	if err := mainInternal(); err != nil {
+	err := mainInternal()
+	if code := exitCode(err); code != 0 {
 		log.Errorf(err.Error())
-		os.Exit(1)
+		os.Exit(code)
+	}
+	if err != nil {
+		log.Infof("Exiting: %v", err)
+	}
+}
+
+// exitCode returns the exit code of the error returned by mainInternal. A
+// SIGTERM or interrupt is the normal way of stopping the exporter, and exits
+// cleanly.
+func exitCode(err error) int {
+	var signalErr run.SignalError
+	if err == nil || errors.As(err, &signalErr) {
+		return 0
+	}
+	var exitErr *exitError
+	if errors.As(err, &exitErr) {
+		return exitErr.code
+	}
+	return 1
+}
+
+// parseList splits a comma-separated flag value, trimming the entries of
+// surrounding whitespace and dropping empty and duplicate entries while
+// preserving the order of the remaining ones.
+func parseList(value, flagName string) []string {
+	var list []string
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		if seen[item] {
+			log.Warningf("Ignoring duplicate %q in %s", item, flagName)
+			continue
+		}
+		seen[item] = true
+		list = append(list, item)
+	}
+	return list
+}
+
+// exitCodeConfig is the exit code for configuration errors, as opposed to
+// runtime failures which exit with 1.
+const exitCodeConfig = 2
+
+// exitError is an error requesting a specific exit code.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+
+func (e *exitError) Unwrap() error { return e.err }
+
+// serve serves the listener until the server is shut down, which is no error.
+func serve(server *http.Server, listener net.Listener) error {
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// shutdownServer shuts the server down, waiting at most -shutdown-timeout for
+// the in-flight requests. The timeout is not derived from the run group
+// context, which the other actors may have canceled already, so that the
+// in-flight scrapes get the whole timeout.
+func shutdownServer(server *http.Server) error {
+	shuttingDown.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return server.Shutdown(ctx)
+}
+
+// listen opens the listener of the server, reporting an address conflict as a
+// configuration error.
+func listen(addr, flagName string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		if errors.Is(err, syscall.EADDRINUSE) {
+			return nil, &exitError{
+				code: exitCodeConfig,
+				err:  fmt.Errorf("address %s is already in use by another process, choose a different one with %s: %w", addr, flagName, err),
+			}
+		}
+		return nil, err
 	}
+	return listener, nil
 }
 
 func mainInternal() error {
-	config, err := rest.InClusterConfig()
+	if listStrategy != listPerNode && listStrategy != listSingle && listStrategy != listInformer {
+		return fmt.Errorf("invalid list strategy %q", listStrategy)
+	}
+	if listPageSize < 0 {
+		return fmt.Errorf("invalid list page size %d", listPageSize)
+	}
+
+	if labelsMode != labelsSeparate && labelsMode != labelsJoined {
+		return fmt.Errorf("invalid labels mode %q", labelsMode)
+	}
+
+	if !labelNameRE.MatchString(nodeLabelKey) || strings.HasPrefix(nodeLabelKey, "__") {
+		return fmt.Errorf("invalid node label key %q", nodeLabelKey)
+	}
+
+	if !strings.HasPrefix(metricsPath, "/") {
+		return fmt.Errorf("invalid metrics path %q", metricsPath)
+	}
+
+	if occupancyBasis != basisAllocatable && occupancyBasis != basisCapacity {
+		return fmt.Errorf("invalid occupancy basis %q", occupancyBasis)
+	}
+
+	if occupancyFrom != occupancyFromRequests && occupancyFrom != occupancyFromLimits {
+		return fmt.Errorf("invalid occupancy numerator %q", occupancyFrom)
+	}
+	if schedulerAccurate && (excludeTerminating || len(qosFilter) != 0) {
+		return errors.New("-scheduler-accurate accounts for all pods, it excludes -exclude-terminating and -qos-filter")
+	}
+	if initZeroSeries && omitZero {
+		return errors.New("-init-zero-series and -omit-zero are mutually exclusive")
+	}
+	if (len(tlsCertFile) == 0) != (len(tlsKeyFile) == 0) {
+		return errors.New("-tls-cert-file and -tls-key-file must be set together")
+	}
+	if limitsAggregation != limitsSum && limitsAggregation != limitsMax {
+		return fmt.Errorf("invalid limits aggregation %q", limitsAggregation)
+	}
+
+	if warmupSamples < 0 || (warmupSamples > 1 && warmupSampleSpacing <= 0) {
+		return fmt.Errorf("invalid warmup samples %d and spacing %v", warmupSamples, warmupSampleSpacing)
+	}
+
+	if shutdownTimeout <= 0 {
+		return fmt.Errorf("invalid shutdown timeout %v", shutdownTimeout)
+	}
+	if tickTimeout < 0 {
+		return fmt.Errorf("invalid tick timeout %v", tickTimeout)
+	}
+
+	if kubeQPS <= 0 || kubeBurst < 1 {
+		return fmt.Errorf("invalid kube QPS %v and burst %d", kubeQPS, kubeBurst)
+	}
+
+	if headroomFraction < 0 || headroomFraction >= 1 {
+		return fmt.Errorf("invalid headroom fraction %v", headroomFraction)
+	}
+
+	if cpuUnit != cpuCores && cpuUnit != cpuMillicores {
+		return fmt.Errorf("invalid cpu unit %q", cpuUnit)
+	}
+
+	if shardTotal < 1 || shard < 0 || shard >= shardTotal {
+		return fmt.Errorf("invalid shard %d of %d", shard, shardTotal)
+	}
+
+	if maxNodes < 0 {
+		return fmt.Errorf("invalid max nodes %d", maxNodes)
+	}
+
+	nodeNames = make(map[string]bool)
+	for _, name := range parseList(nodeNamesStr, "-nodes") {
+		nodeNames[name] = true
+	}
+
+	if maxLabelLength < 0 {
+		return fmt.Errorf("invalid max label length %d", maxLabelLength)
+	}
+
+	labelValueAllowlist = make(map[string]map[string]bool)
+	for _, pair := range parseList(labelValueAllowlistStr, "-label-value-allowlist") {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || len(name) == 0 {
+			return fmt.Errorf("invalid label value allowlist entry %q, expected label=value", pair)
+		}
+		if labelValueAllowlist[name] == nil {
+			labelValueAllowlist[name] = make(map[string]bool)
+		}
+		labelValueAllowlist[name][value] = true
+	}
+
+	if len(podFieldSelectorStr) != 0 {
+		selector, err := fields.ParseSelector(podFieldSelectorStr)
+		if err != nil {
+			return fmt.Errorf("invalid pod field selector %q: %v", podFieldSelectorStr, err)
+		}
+		podFieldSelector = selector
+	}
+
+	qosClasses = make(map[corev1.PodQOSClass]bool)
+	for _, class := range parseList(qosFilter, "-qos-filter") {
+		switch qos := corev1.PodQOSClass(class); qos {
+		case corev1.PodQOSGuaranteed, corev1.PodQOSBurstable, corev1.PodQOSBestEffort:
+			qosClasses[qos] = true
+		default:
+			return fmt.Errorf("invalid QoS class %q", class)
+		}
+	}
+
+	excludedContainerNames = parseList(excludeContainerNamesStr, "-exclude-container-names")
+	for _, pattern := range excludedContainerNames {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid container name pattern %q: %v", pattern, err)
+		}
+	}
+
+	if len(configFile) != 0 {
+		if err := loadConfigFile(configFile); err != nil {
+			return err
+		}
+	}
+	applyConfig()
+	if err := checkNodeLabelKey(); err != nil {
+		return &exitError{code: exitCodeConfig, err: err}
+	}
+
+	kubeconfigs, err := parseKubeconfigs(kubeconfigsStr)
 	if err != nil {
 		return err
 	}
+	if demo && len(kubeconfigs) != 0 {
+		return fmt.Errorf("invalid kubeconfigs %q in demo mode", kubeconfigsStr)
+	}
 
-	kubeClient, err := kubernetes.NewForConfig(config)
+	units, err := parseResourceUnits(resourceUnits)
 	if err != nil {
 		return err
 	}
+	if resourceAliases, err = parseResourceAliases(resourceAliasesStr, trackedResourceNames); err != nil {
+		return err
+	}
+	if resourceScales, err = parseResourceScales(resourceScalesStr); err != nil {
+		return err
+	}
+	if resourceIntervals, err = parseResourceIntervals(resourceIntervalsStr); err != nil {
+		return err
+	}
+	divisors, unitNames, err := parseUnits(unitConversionsStr)
+	if err != nil {
+		return err
+	}
+	// the conversions compose with the -resource-scale factors
+	for resource, divisor := range divisors {
+		scale, ok := resourceScales[resource]
+		if !ok {
+			scale = 1
+		}
+		resourceScales[resource] = scale / divisor
+		units[resource] = unitNames[resource]
+	}
+	if occupancyCritical, err = parseOccupancyCritical(occupancyCriticalStr); err != nil {
+		return err
+	}
+	if occupancyBases, err = parseOccupancyBases(occupancyBasesStr); err != nil {
+		return err
+	}
+	if occupancyQuantileWindow < 0 {
+		return fmt.Errorf("invalid occupancy quantile window %d", occupancyQuantileWindow)
+	}
+	if occupancyQuantiles, err = parseQuantiles(occupancyQuantilesStr, "-occupancy-quantiles"); err != nil {
+		return err
+	}
+	if occupancySummaryWindow < 0 {
+		return fmt.Errorf("invalid occupancy summary window %v", occupancySummaryWindow)
+	}
+	if occupancySummaryObjectives, err = parseQuantiles(summaryObjectivesStr, "-occupancy-summary-objectives"); err != nil {
+		return err
+	}
+	if len(scoreExprStr) != 0 {
+		if scoreExpr, err = metrics.CompileScoreExpr(scoreExprStr); err != nil {
+			return err
+		}
+	}
+	// The exporter registers its own runtime and process collectors rather
+	// than relying on those of the default registry.
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	// Every cluster of -kubeconfigs has its own sampler whose series carry
+	// the cluster label, all registered into the same registry.
+	var samplers []*sampler
+	switch {
+	case demo:
+		samplers = append(samplers, newSampler("", nil, nil, registry, metrics.New(registry, nodeLabelKey, nodeLabelNames(), units)))
+	case len(kubeconfigs) == 0:
+		config, err := rest.InClusterConfig()
+		if err != nil {
+			return err
+		}
+		kubeClient, metricsClient, err := newClients(config)
+		if err != nil {
+			return err
+		}
+		samplers = append(samplers, newSampler("", kubeClient, metricsClient, registry, metrics.New(registry, nodeLabelKey, nodeLabelNames(), units)))
+	default:
+		for _, kubeconfig := range kubeconfigs {
+			config, err := kubeconfig.restConfig()
+			if err != nil {
+				return err
+			}
+			kubeClient, metricsClient, err := newClients(config)
+			if err != nil {
+				return err
+			}
+			reg := prometheus.WrapRegistererWith(prometheus.Labels{"cluster": kubeconfig.cluster}, registry)
+			samplers = append(samplers, newSampler(kubeconfig.cluster, kubeClient, metricsClient, reg, metrics.New(reg, nodeLabelKey, nodeLabelNames(), units)))
+		}
+	}
+	if err := selfTest(samplers[0].metric); err != nil {
+		return err
+	}
+	interval := samplingInterval
+	if scrapeTimeCollection {
+		interval = scrapeCacheTTL
+	}
+	for _, s := range samplers {
+		s.metric.SampleInterval.Set(interval.Seconds())
+		if occupancySummaryWindow > 0 {
+			s.metric.EnableOccupancySummary(occupancySummaryObjectives, occupancySummaryWindow)
+		}
+		if nativeHistograms {
+			s.metric.EnablePodDensityHistogram(s.reg)
+		}
+	}
 
-	metric := metrics.New(strings.Split(nodeLabels, ","))
-	resourceScores = *metrics.NewResourceScore()
-
+	instrument := newHandlerInstrumenter(registry)
 	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle(metricsPath, instrument(metricsPath, promhttp.InstrumentMetricHandler(registry, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))))
+	mux.Handle("GET /snapshot.json", instrument("/snapshot.json", handleSnapshotJSON(registry)))
+	mux.Handle("/healthz", instrument("/healthz", http.HandlerFunc(handleHealthz)))
+	mux.Handle("/readyz", instrument("/readyz", handleReadyz(time.Now())))
 	promServer := &http.Server{
 		Addr:    fmt.Sprintf(":%d", port),
-		Handler: mux,
+		Handler: rejectWhenShuttingDown(mux),
+	}
+
+	// Admin and debug endpoints are served on the main port unless
+	// -admin-listen moves them to a separate listener.
+	adminMux := mux
+	var adminServer *http.Server
+	if len(adminListen) != 0 {
+		adminMux = http.NewServeMux()
+		adminServer = &http.Server{
+			Addr:    adminListen,
+			Handler: rejectWhenShuttingDown(adminMux),
+		}
+	}
+	adminMux.Handle("GET /node/{name}/metrics", instrument("/node/{name}/metrics", handleNodeMetrics(registry)))
+	adminMux.Handle("GET /config", instrument("/config", requireAdmin(handleConfig)))
+	if !demo {
+		adminMux.Handle("POST /sample", instrument("/sample", requireAdmin(handleSample(samplers))))
+	}
+	adminMux.Handle("PUT /loglevel", instrument("/loglevel", requireAdmin(handleLogLevel)))
+
+	serverTLS, err := tlsConfig()
+	if err != nil {
+		return &exitError{code: exitCodeConfig, err: fmt.Errorf("invalid TLS certificate: %w", err)}
+	}
+	listener, err := listen(promServer.Addr, "-p")
+	if err != nil {
+		return err
+	}
+	var adminListener net.Listener
+	if adminServer != nil {
+		if adminListener, err = listen(adminServer.Addr, "-admin-listen"); err != nil {
+			_ = listener.Close()
+			return err
+		}
+	}
+	if serverTLS != nil {
+		listener = tls.NewListener(listener, serverTLS)
+		if adminListener != nil {
+			adminListener = tls.NewListener(adminListener, serverTLS)
+		}
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -72,39 +662,205 @@ func mainInternal() error {
 	g.Add(
 		func() error {
 			log.Infof("Starting Node Resource Exporter on port %d", port)
-			return promServer.ListenAndServe()
+			return serve(promServer, listener)
 		},
 		func(err error) {
 			log.Infof("Stopping Node Resource Exporter: %v", err)
-			if err := promServer.Shutdown(ctx); err != nil {
+			if err := shutdownServer(promServer); err != nil {
 				log.Infof("Error during server shutdown: %v", err)
 			}
 			log.Infof("Stopped Node Resource Exporter")
 		})
-	// Resource sampling loop
-	g.Add(
-		func() error {
-			log.Infof("Starting sampling loop")
-			return startResourceSamplingLoop(ctx, kubeClient, strings.Split(resources, ","), metric)
-		},
-		func(err error) {
-			log.Infof("Stopping sampling loop: %v", err)
-			cancel()
-			log.Infof("Stopped sampling loop")
-		})
+	if adminServer != nil {
+		// Admin endpoints
+		g.Add(
+			func() error {
+				log.Infof("Starting admin server on %s", adminServer.Addr)
+				return serve(adminServer, adminListener)
+			},
+			func(err error) {
+				log.Infof("Stopping admin server: %v", err)
+				if err := shutdownServer(adminServer); err != nil {
+					log.Infof("Error during admin server shutdown: %v", err)
+				}
+				log.Infof("Stopped admin server")
+			})
+	}
+	if watchdogExit && watchdogIntervals > 0 {
+		// Sampling loop watchdog
+		g.Add(
+			func() error {
+				return startWatchdog(ctx)
+			},
+			func(err error) {
+				cancel()
+			})
+	}
+	for _, s := range samplers {
+		if s.kubeClient == nil || listStrategy != listInformer {
+			break
+		}
+		factory, err := s.newPodInformerFactory()
+		if err != nil {
+			return err
+		}
+		// Pod informer
+		g.Add(
+			func() error {
+				log.Infof("Starting informers%s", s.clusterSuffix())
+				return startInformers(ctx, factory)
+			},
+			func(err error) {
+				log.Infof("Stopping informers%s: %v", s.clusterSuffix(), err)
+				cancel()
+			})
+	}
+	if len(configFile) != 0 {
+		// Config file reloader
+		g.Add(
+			func() error {
+				log.Infof("Starting config reloader")
+				return startConfigReloader(ctx, func() error { return reloadConfig(samplers, units) })
+			},
+			func(err error) {
+				log.Infof("Stopping config reloader: %v", err)
+				cancel()
+			})
+	}
+	if len(otlpEndpoint) != 0 {
+		// OTLP exporter
+		g.Add(
+			func() error {
+				log.Infof("Starting OTLP exporter to %s", otlpEndpoint)
+				return startOTLPExporter(ctx, samplers)
+			},
+			func(err error) {
+				log.Infof("Stopping OTLP exporter: %v", err)
+				cancel()
+			})
+	}
+	if len(outputFile) != 0 {
+		// Metrics file writer
+		g.Add(
+			func() error {
+				log.Infof("Starting file writer to %s", outputFile)
+				return startFileWriter(ctx, registry)
+			},
+			func(err error) {
+				log.Infof("Stopping file writer: %v", err)
+				cancel()
+			})
+	}
+	if demo {
+		// Synthetic data loop
+		g.Add(
+			func() error {
+				log.Infof("Starting demo loop")
+				return startDemoLoop(ctx, samplers[0])
+			},
+			func(err error) {
+				log.Infof("Stopping demo loop: %v", err)
+				cancel()
+				log.Infof("Stopped demo loop")
+			})
+
+		return g.Run()
+	}
+	if scrapeTimeCollection {
+		// Sample on demand from the collector instead of running a ticker.
+		// Scrapes must reach the exporter to sample, so it is ready at once.
+		sampled.Store(true)
+		for _, s := range samplers {
+			s.metric.SetRefresher(func() {
+				s.reportResourceUsage(ctx)
+			}, scrapeCacheTTL)
+		}
+
+		return g.Run()
+	}
+	for _, s := range samplers {
+		// Resource sampling loop
+		g.Add(
+			func() error {
+				log.Infof("Starting sampling loop%s", s.clusterSuffix())
+				return startResourceSamplingLoop(ctx, s)
+			},
+			func(err error) {
+				log.Infof("Stopping sampling loop%s: %v", s.clusterSuffix(), err)
+				cancel()
+				log.Infof("Stopped sampling loop%s", s.clusterSuffix())
+			})
+	}
 
 	return g.Run()
 }
 
-func startResourceSamplingLoop(ctx context.Context, kubeClient *kubernetes.Clientset, resources []string, metric *metrics.Metrics) error {
+func startResourceSamplingLoop(ctx context.Context, s *sampler) error {
 	defer log.Infof("Exited sampling loop")
-	ticker := time.NewTicker(10 * time.Second)
+
+	first := true
+	timedOut := false
+	sample := func() error {
+		passCtx := ctx
+		if tickTimeout > 0 {
+			var cancel context.CancelFunc
+			passCtx, cancel = context.WithTimeout(ctx, tickTimeout)
+			defer cancel()
+		}
+		n, err := s.reportResourceUsage(passCtx)
+		if errors.Is(err, errPassInProgress) {
+			return nil
+		}
+		if ctx.Err() == nil && errors.Is(passCtx.Err(), context.DeadlineExceeded) {
+			log.Infof("ERROR: sampling pass%s aborted after the tick timeout of %v", s.clusterSuffix(), tickTimeout)
+			s.metric.TickTimeouts.Inc()
+			timedOut = true
+		}
+		if failFast && first {
+			if err != nil {
+				return fmt.Errorf("first sampling pass failed: %w", err)
+			}
+			if n == 0 {
+				return errors.New("first sampling pass found no nodes")
+			}
+		}
+		first = false
+		return nil
+	}
+
+	// the -warmup-samples give the score a few samples to start from before
+	// the first tick
+	for i := range warmupSamples {
+		if i > 0 {
+			select {
+			case <-time.After(warmupSampleSpacing):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if err := sample(); err != nil {
+			return err
+		}
+	}
+
+	ticker := time.NewTicker(samplingInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			reportResourceUsage(ctx, kubeClient, resources, metric)
+			if err := sample(); err != nil {
+				return err
+			}
+			// the tick missed during an aborted pass would start the next
+			// one right away, wait for the next scheduled tick instead
+			if timedOut {
+				select {
+				case <-ticker.C:
+				default:
+				}
+				timedOut = false
+			}
 
 		case <-ctx.Done():
 			return ctx.Err()
@@ -112,81 +868,533 @@ func startResourceSamplingLoop(ctx context.Context, kubeClient *kubernetes.Clien
 	}
 }
 
-func reportResourceUsage(ctx context.Context, kubeClient *kubernetes.Clientset, resources []string, metric *metrics.Metrics) {
-	nodeList, err := kubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+// reportResourceUsage samples the nodes and returns the number of reported nodes.
+func (s *sampler) reportResourceUsage(ctx context.Context) (int, error) {
+	if !s.passMu.TryLock() {
+		return 0, errPassInProgress
+	}
+	defer s.passMu.Unlock()
+	// a failing pass keeps the exporter live, see samplingStuck
+	defer markAttempted()
+	configMu.RLock()
+	defer configMu.RUnlock()
+
+	if !s.isPassDue(time.Now()) {
+		// the resources keep their values until their next interval
+		markSampled()
+		return len(s.lastNodeUpdate), nil
+	}
+
+	nodeList, err := s.kubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
 	if err != nil {
-		log.Infof("ERROR: failed to list the nodes: %v", err)
-		return
+		log.Infof("ERROR: failed to list the nodes%s: %v", s.clusterSuffix(), err)
+		// keep serving the previous snapshot through brief API failures
+		s.metric.Stale.Set(1)
+		if staleTTL > 0 && !s.lastPass.IsZero() && time.Since(s.lastPass) > staleTTL {
+			log.Infof("Dropping the metrics%s sampled %v ago", s.clusterSuffix(), time.Since(s.lastPass).Round(time.Second))
+			s.metric.Update(s.metric.NewSnapshot())
+			s.lastPass = time.Time{}
+		}
+		return 0, err
 	}
 
-	for _, node := range nodeList.Items {
-		nodeLabelValues := make([]string, len(metric.NodeLabelNames))
-		for i, name := range metric.NodeLabelNames {
-			nodeLabelValues[i] = node.Labels[name]
+	// the nodes of all shards and exclusions may run the unscheduled pods
+	advertised := advertisedResources(nodeList.Items)
+	nodeList.Items = selectNodes(nodeList.Items)
+	podUsage, err := listPodUsage(ctx, s.metricsClient)
+	if err != nil {
+		log.Infof("ERROR: failed to list the pod metrics: %v", err)
+	}
+	usages := s.listNodeUsage(ctx, nodeList.Items, podUsage)
+
+	cluster := newClusterUsage()
+	if resourceClaims {
+		if cluster.claimDevices, err = listClaimDevices(ctx, s.kubeClient); err != nil {
+			log.Infof("ERROR: failed to list the resource claims: %v", err)
+		}
+	}
+	// unscheduled pods and quotas belong to no shard, the first one reports them
+	if shard == 0 {
+		if cluster.unscheduled, err = listUnscheduledPods(ctx, s.kubeClient, advertised); err != nil {
+			log.Infof("ERROR: failed to list the unscheduled pods: %v", err)
 		}
+		if resourceQuotas {
+			quotas, err := s.kubeClient.CoreV1().ResourceQuotas("").List(ctx, metav1.ListOptions{})
+			if err != nil {
+				log.Infof("ERROR: failed to list the resource quotas: %v", err)
+			} else {
+				cluster.quotas = quotas.Items
+			}
+		}
+	}
 
-		pods, err := kubeClient.CoreV1().Pods("").List(ctx, metav1.ListOptions{FieldSelector: "spec.nodeName=" + node.Name})
-		if err != nil {
-			log.Infof("ERROR: failed to get pods for node %s: %v", node.Name, err)
+	// the nodes of a pass canceled midway, e.g. by the -tick-timeout, would
+	// be published as failed
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s.reportNodes(nodeList.Items, usages, trackedResourceNames, cluster)
+	s.metric.Stale.Set(0)
+	s.lastPass = time.Now()
+	return len(nodeList.Items), nil
+}
+
+// reportNodes publishes a snapshot of the metrics of the nodes, given the
+// usage of their pods, and of the cluster. The usage of a node whose pods
+// could not be listed is nil.
+func (s *sampler) reportNodes(nodes []corev1.Node, usages []*nodeUsage, resources []string, cluster *clusterUsage) {
+	now := time.Now()
+	if staleGracePeriod > 0 {
+		nodes, usages = s.retainMissingNodes(nodes, usages, now)
+	}
+	seen := make(map[string]bool, len(nodes))
+	snapshot := s.metric.NewSnapshot()
+	notReady := 0
+	// the configured resources are listed even without nodes, the
+	// discovered ones once a node has them
+	tracked := make(map[string]bool)
+	for _, resource := range trackedResources(&corev1.Node{}, resources) {
+		tracked[resource] = true
+	}
+	for i := range nodes {
+		node := &nodes[i]
+		seen[node.Name] = true
+		nodeLabelValues := getNodeLabelValues(node)
+		reportNodeStatus(node, nodeLabelValues, snapshot)
+		// a node registering has no allocatable resources for a moment, of
+		// which all the occupancies would be missing or infinite
+		if len(node.Status.Allocatable) == 0 {
+			log.V(2).Infof("Skipping node %s without allocatable resources", node.Name)
+			notReady++
 			continue
 		}
+		for _, resource := range trackedResources(node, resources) {
+			tracked[resource] = true
+		}
+		if initZeroSeries {
+			reportZeroSeries(node, nodeLabelValues, resources, snapshot)
+		}
+		if usages[i] != nil {
+			s.reportNodeUsage(node, nodeLabelValues, usages[i], resources, now, cluster, snapshot)
+			s.lastNodeUpdate[node.Name] = now
+			s.metric.NodeScrapes.WithLabelValues("success").Inc()
+		} else {
+			s.metric.NodeScrapes.WithLabelValues("error").Inc()
+		}
+		if updated, ok := s.lastNodeUpdate[node.Name]; ok {
+			labels := append([]string{node.Name}, nodeLabelValues...)
+			snapshot.NodeLastUpdate.WithLabelValues(labels...).Set(float64(updated.Unix()))
+		}
+	}
+	for name := range s.lastNodeUpdate {
+		if !seen[name] {
+			delete(s.lastNodeUpdate, name)
+		}
+	}
+	s.pruneHistories(seen)
+	snapshot.NodesNotReadyForMetrics.WithLabelValues().Set(float64(notReady))
+	for resource := range tracked {
+		snapshot.TrackedResource.WithLabelValues(resource).Set(1)
+	}
+	if len(nodes) != 0 {
+		unused := unusedLabelKeys(nodes)
+		if !slices.Equal(unused, s.unusedLabelKeys) {
+			for _, key := range unused {
+				log.Warningf("No node has the label %q of -l, its values are empty", key)
+			}
+			s.unusedLabelKeys = unused
+		}
+		snapshot.UnusedLabelKeys.WithLabelValues().Set(float64(len(unused)))
+	}
+	if s.podWatch != nil {
+		synced := 0.0
+		if s.podWatch.connected() {
+			synced = 1
+		}
+		snapshot.InformerSynced.WithLabelValues().Set(synced)
+	}
+	if scoreTTL > 0 {
+		s.scores.Expire(now.Add(-scoreTTL))
+	}
+	s.markResourcesSampled(now)
+	cluster.report(snapshot)
+	if s.occupancies != nil {
+		s.occupancies.add(cluster.occupancies)
+		s.occupancies.report(snapshot)
+	}
+	s.metric.Update(snapshot)
+	markSampled()
+}
+
+func getNodeLabelValues(node *corev1.Node) []string {
+	var nodeLabelValues []string
+	if labelsMode == labelsJoined {
+		pairs := make([]string, len(nodeLabelKeys))
+		for i, name := range nodeLabelKeys {
+			pairs[i] = name + "=" + nodeLabelValue(node, name)
+		}
+		nodeLabelValues = []string{strings.Join(pairs, ",")}
+	} else {
+		nodeLabelValues = make([]string, len(nodeLabelKeys))
+		for i, name := range nodeLabelKeys {
+			nodeLabelValues[i] = nodeLabelValue(node, name)
+		}
+	}
+	// the node info is reported by the kubelet, unlike the labels which
+	// anyone may edit
+	if includeArchOS {
+		nodeLabelValues = append(nodeLabelValues, node.Status.NodeInfo.Architecture, node.Status.NodeInfo.OperatingSystem)
+	}
+	return nodeLabelValues
+}
 
-		requests := corev1.ResourceList{}
-		limits := corev1.ResourceList{}
+// otherLabelValue replaces the node label values missing from the -label-value-allowlist.
+const otherLabelValue = "other"
 
-		for _, pod := range pods.Items {
-			if pod.Status.Phase != corev1.PodRunning {
-				continue
-			}
-			for _, container := range pod.Spec.Containers {
-				addResourceList(requests, container.Resources.Requests)
-				addResourceList(limits, container.Resources.Limits)
+// nodeLabelValue returns the value of the node label, bounded by the
+// -label-value-allowlist and -max-label-length.
+func nodeLabelValue(node *corev1.Node, name string) string {
+	value := node.Labels[name]
+	if allowed, ok := labelValueAllowlist[name]; ok && len(value) != 0 && !allowed[value] {
+		return otherLabelValue
+	}
+	if maxLabelLength > 0 && len(value) > maxLabelLength {
+		return value[:maxLabelLength]
+	}
+	return value
+}
+
+// reportZeroSeries sets the main series of each tracked resource of the node
+// to 0, before the sampled values overwrite them, so that the series exist
+// whether or not the resource could be sampled, e.g. for absent() alerts.
+func reportZeroSeries(node *corev1.Node, nodeLabelValues []string, resources []string, metric *metrics.Snapshot) {
+	for _, resource := range trackedResources(node, resources) {
+		labels := append([]string{node.Name, resourceLabelValue(resource)}, nodeLabelValues...)
+		for _, gauge := range []*prometheus.GaugeVec{
+			metric.NodeResourceRequests,
+			metric.NodeResourceLimits,
+			metric.NodeResourceOccupancy,
+			metric.NodeResourceAllocatable,
+			metric.NodeResourceAvailable,
+		} {
+			gauge.WithLabelValues(labels...).Set(0)
+		}
+	}
+}
+
+// reportNodeStatus reports the metrics derived from the node object alone.
+func reportNodeStatus(node *corev1.Node, nodeLabelValues []string, metric *metrics.Snapshot) {
+	labels := append([]string{node.Name}, nodeLabelValues...)
+
+	metric.NodeAge.WithLabelValues(labels...).Set(time.Since(node.CreationTimestamp.Time).Seconds())
+
+	ready := 0.0
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == corev1.NodeReady && cond.Status == corev1.ConditionTrue {
+			ready = max(0, time.Since(cond.LastTransitionTime.Time).Seconds())
+		}
+	}
+	metric.NodeReady.WithLabelValues(labels...).Set(ready)
+
+	info := node.Status.NodeInfo
+	metric.NodeInfo.WithLabelValues(node.Name, node.Spec.ProviderID, node.Labels[corev1.LabelInstanceTypeStable],
+		info.OSImage, info.KernelVersion, info.KubeletVersion, info.ContainerRuntimeVersion,
+		info.OperatingSystem, info.Architecture).Set(1)
+
+	tainted := false
+	for _, taint := range node.Spec.Taints {
+		if taint.Effect == corev1.TaintEffectNoSchedule || taint.Effect == corev1.TaintEffectNoExecute {
+			tainted = true
+			metric.NodeTainted.WithLabelValues(append([]string{node.Name, taint.Key, string(taint.Effect)}, nodeLabelValues...)...).Set(1)
+		}
+	}
+	if !tainted {
+		metric.NodeTainted.WithLabelValues(append([]string{node.Name, "", ""}, nodeLabelValues...)...).Set(0)
+	}
+}
+
+func (s *sampler) reportNodeUsage(node *corev1.Node, nodeLabelValues []string, usage *nodeUsage, resources []string, now time.Time, cluster *clusterUsage, metric *metrics.Snapshot) {
+	requests, limits := usage.requests, usage.limits
+
+	log.Infof("Total requests on node %s: %v", node.Name, requests)
+	log.Infof("Total limits on node %s: %v", node.Name, limits)
+
+	nodeOnlyLabels := append([]string{node.Name}, nodeLabelValues...)
+	metric.NodeRequestlessPods.WithLabelValues(nodeOnlyLabels...).Set(float64(usage.requestless))
+	metric.NodeContainerCount.WithLabelValues(nodeOnlyLabels...).Set(float64(usage.containers))
+	metric.NodeContainerRestarts.WithLabelValues(nodeOnlyLabels...).Set(float64(usage.restarts))
+	if usage.podUsage != nil {
+		metric.NodePodRequestOverage.WithLabelValues(nodeOnlyLabels...).Set(float64(usage.requestOverage))
+	}
+
+	for _, reason := range skipReasons {
+		skippedLabels := append([]string{node.Name, reason}, nodeLabelValues...)
+		metric.NodePodsSkipped.WithLabelValues(skippedLabels...).Set(float64(usage.skipped[reason]))
+	}
+
+	if cluster.claimDevices != nil {
+		drivers := make(map[string]int)
+		for claim := range usage.claims {
+			for driver, n := range cluster.claimDevices[claim] {
+				drivers[driver] += n
 			}
 		}
+		for driver, n := range drivers {
+			claimLabels := append([]string{node.Name, driver}, nodeLabelValues...)
+			metric.NodeResourceClaims.WithLabelValues(claimLabels...).Set(float64(n))
+		}
+	}
+
+	cluster.addPodCount(usage.phases[corev1.PodRunning])
+	if density := s.metric.NodePodDensity; density != nil {
+		density.Observe(float64(usage.phases[corev1.PodRunning]))
+	}
+	if podPhaseMetrics {
+		for _, phase := range podPhases {
+			phaseLabels := append([]string{node.Name, string(phase)}, nodeLabelValues...)
+			metric.NodePodPhaseCount.WithLabelValues(phaseLabels...).Set(float64(usage.phases[phase]))
+		}
+	}
 
-		log.Infof("Total requests on node %s: %v", node.Name, requests)
-		log.Infof("Total limits on node %s: %v", node.Name, limits)
+	// the occupancy of NotReady nodes is stale, keep it out of the averages
+	reportOccupancy := !readyOnly || isNodeReady(node)
 
-		var val float64
-		for _, resource := range resources {
-			scoreLabels := append([]string{resource}, nodeLabelValues...)
-			labels := append([]string{node.Name}, scoreLabels...)
-			// get resource requests
-			if v, ok := requests[corev1.ResourceName(resource)]; ok {
-				val = v.AsApproximateFloat64()
-			} else {
-				val = 0
-			}
-			metric.NodeResourceRequests.WithLabelValues(labels...).Set(val)
-			// get resource usage in percents
-			if v, ok := node.Status.Allocatable[corev1.ResourceName(resource)]; ok {
-				if allocatable := v.AsApproximateFloat64(); allocatable > 0 {
-					occ := val / allocatable
-					score := resourceScores.Score(resource, occ)
-
-					log.V(4).Infof("%s occupancy: %f score: %f", resource, occ, score)
-					metric.NodeResourceOccupancy.WithLabelValues(labels...).Set(occ * 100.0)
-					metric.NodeResourceScore.WithLabelValues(scoreLabels...).Set(score)
+	prev := s.histories[node.Name]
+	curr := newNodeHistory()
+	defer func() { s.histories[node.Name] = curr }()
+	s.detectLabelDrift(prev, curr, node)
+	curr.labelValues = slices.Clone(nodeLabelValues)
+	if summary := s.metric.NodeResourceOccupancySummary; summary != nil && prev != nil && !slices.Equal(prev.labelValues, curr.labelValues) {
+		// the summary would keep the series of the previous label values
+		summary.DeletePartialMatch(prometheus.Labels{nodeLabelKey: node.Name})
+	}
+
+	// the pods left out by the filters do not keep the node busy
+	curr.idle = usage.accountedPods == usage.requestless
+	idle := 0.0
+	if curr.idle {
+		idle = 1
+		if prev == nil || !prev.idle {
+			log.Infof("Node %s runs no pod requesting cpu or memory", node.Name)
+		}
+	}
+	metric.NodeIdle.WithLabelValues(nodeOnlyLabels...).Set(idle)
+
+	// The label values of a resource are node, resource and the node labels,
+	// those of the score the same without node. They share a single slice
+	// whose resource slot is overwritten for each resource, with room for
+	// the quantity label. Metric vectors copy the label values they keep.
+	fitsLargestRequest := true
+	labels := make([]string, 2+len(nodeLabelValues), 3+len(nodeLabelValues))
+	labels[0] = node.Name
+	copy(labels[2:], nodeLabelValues)
+	scoreLabels := labels[1:]
+	active := 0
+	for _, resource := range trackedResources(node, resources) {
+		// a resource of -resource-intervals not due keeps its previous values
+		used := s.resourceUsage(resource, node.Name, usage, now)
+		requests, limits := used.requests, used.limits
+		// a malformed quantity would expose a broken sample
+		if !s.validAmount(node.Name, resource, "requests", requests) ||
+			!s.validAmount(node.Name, resource, "limits", limits) ||
+			!s.validAmount(node.Name, resource, "allocatable", node.Status.Allocatable) {
+			continue
+		}
+		resourceLabel := resourceLabelValue(resource)
+		labels[1] = resourceLabel
+		// get resource requests and limits
+		req := getQuantity(requests, resource)
+		lim := getQuantity(limits, resource)
+		if n := used.unboundedPods[resource]; n > 0 {
+			// each pod without a limit may use the whole node
+			lim += float64(n) * getQuantity(node.Status.Allocatable, resource)
+		}
+		// series omitted from the snapshot disappear from the next scrape
+		if req != 0 || !omitZero {
+			metric.NodeResourceRequests.WithLabelValues(labels...).Set(req)
+			if emitQuantityInfo {
+				quantity := requests[corev1.ResourceName(resource)]
+				metric.NodeResourceRequestsQuantity.WithLabelValues(append(labels, quantity.String())...).Set(1)
+			}
+		}
+		if lim != 0 || !omitZero {
+			metric.NodeResourceLimits.WithLabelValues(labels...).Set(lim)
+		}
+		if len(excludedContainerNames) != 0 {
+			metric.NodeResourceRequestsSidecar.WithLabelValues(labels...).Set(getQuantity(used.sidecarRequests, resource))
+		}
+		for owner, ownerRequests := range used.ownerRequests {
+			if v, ok := ownerRequests[corev1.ResourceName(resource)]; ok {
+				metric.NodeResourceRequestsByOwner.WithLabelValues(append(labels, owner.namespace, owner.kind, owner.name)...).Set(quantityValue(resource, v))
+			}
+		}
+		for class, classRequests := range used.priorityRequests {
+			if v, ok := classRequests[corev1.ResourceName(resource)]; ok {
+				metric.NodeResourceRequestsByPriority.WithLabelValues(append(labels, class)...).Set(quantityValue(resource, v))
+			}
+		}
+		curr.requests[resource] = req
+		if req != 0 {
+			active++
+		}
+		cluster.addRequests(labels, resourceLabel, amount(req))
+		if prev != nil {
+			if prevReq, ok := prev.requests[resource]; ok {
+				metric.NodeResourceRequestsDelta.WithLabelValues(labels...).Set(req - prevReq)
+			}
+		}
+		if gap, ok := used.provisioningGap[resource]; ok {
+			metric.NodeResourceProvisioningGap.WithLabelValues(labels...).Set(gap)
+		}
+		metric.NodeResourceMaxContainerRequest.WithLabelValues(labels...).Set(getQuantity(used.maxContainerRequests, resource))
+		// a running pod requesting more than allocatable outlived a shrink of the node
+		exceeds := 0.0
+		if getQuantity(used.maxPodRequests, resource) > getQuantity(node.Status.Allocatable, resource) {
+			exceeds = 1
+		}
+		metric.NodePodExceedsAllocatable.WithLabelValues(labels...).Set(exceeds)
+		metric.NodeResourceUnboundedPodCount.WithLabelValues(labels...).Set(float64(used.accountedPods - used.resourcePods[resource]))
+		metric.NodeResourceEffectiveDelta.WithLabelValues(labels...).Set(req - getQuantity(used.containerRequests, resource))
+		if req > 0 {
+			metric.NodeResourceLimitRequestRatio.WithLabelValues(labels...).Set(round(lim / req))
+		}
+		metric.NodeResourceAllocatableChanged.WithLabelValues(labels...).Add(curr.countAllocatableChanges(prev, node, resource))
+		// a resource missing from the allocatable resources has no room
+		if cluster.unscheduled != nil {
+			if largest, ok := cluster.unscheduled.largestRequests[corev1.ResourceName(resource)]; ok && getQuantity(node.Status.Allocatable, resource)-req < quantityValue(resource, largest) {
+				fitsLargestRequest = false
+			}
+		}
+		// get schedulable headroom
+		if v, ok := node.Status.Allocatable[corev1.ResourceName(resource)]; ok {
+			allocatable := quantityValue(resource, v)
+			metric.NodeResourceAllocatable.WithLabelValues(labels...).Set(allocatable)
+			metric.NodeResourceWorkloadHeadroom.WithLabelValues(labels...).Set(allocatable - getQuantity(used.daemonSetRequests, resource))
+			overcommitted := 0.0
+			if req > allocatable {
+				overcommitted = 1
+			}
+			metric.NodeResourceOvercommitted.WithLabelValues(labels...).Set(overcommitted)
+			if allocatable > 0 {
+				available := allocatable - req
+				metric.NodeResourceAvailable.WithLabelValues(labels...).Set(available)
+				cluster.addAvailable(resourceLabel, amount(available))
+				metric.NodeResourceSchedulableRatio.WithLabelValues(labels...).Set(round(available / allocatable))
+			}
+		}
+		// get resource usage in percents
+		if denominator, ok := occupancyDenominator(node, resource); ok && denominator > 0 && reportOccupancy {
+			occupied := req
+			if occupancyFrom == occupancyFromLimits {
+				occupied = lim
+			}
+			if instanceType, ok := node.Labels[instanceTypeLabel]; ok && instanceTypeLabel != "" {
+				addSummedOccupancy(cluster.instanceTypes, instanceType, resourceLabel, amount(occupied), amount(denominator))
+			}
+			if zone, ok := node.Labels[zoneLabel]; ok && zoneLabel != "" {
+				addSummedOccupancy(cluster.zones, zone, resourceLabel, amount(occupied), amount(denominator))
+			}
+			occ := occupied / denominator
+			if clampOccupancy {
+				occ = min(occ, 1)
+			}
+			percent := occ * 100.0
+			if resource == string(corev1.ResourceCPU) && cpuOccupancyDigits >= 0 {
+				// drop the float noise of the cpu amounts, e.g. 300m of 1 cpu is 30%
+				percent = roundTo(percent, cpuOccupancyDigits)
+			}
+			score := s.scores.Score(resource, node.Name, occ, now)
+
+			log.V(4).Infof("%s occupancy: %f score: %f", resource, occ, score)
+			metric.NodeResourceOccupancy.WithLabelValues(labels...).Set(round(percent))
+			limOcc := lim / denominator
+			if clampOccupancy {
+				limOcc = min(limOcc, 1)
+			}
+			metric.NodeResourceOccupancyLimits.WithLabelValues(labels...).Set(round(limOcc * 100.0))
+			if summary := s.metric.NodeResourceOccupancySummary; summary != nil {
+				summary.WithLabelValues(labels...).Observe(percent)
+			}
+			if threshold, ok := criticalOccupancy(resource); ok {
+				overloaded := 0.0
+				if percent > threshold {
+					overloaded = 1
 				}
+				metric.NodeResourceOverloaded.WithLabelValues(labels...).Set(overloaded)
 			}
-			// get resource limits
-			if v, ok := limits[corev1.ResourceName(resource)]; ok {
-				val = v.AsApproximateFloat64()
-			} else {
-				val = 0
+			if weightedOccupancy {
+				metric.NodeResourceWeightedOccupancy.WithLabelValues(labels...).Set(round(used.weightedRequests[resource] / denominator * 100.0))
+			}
+			if occupancyEWMAHalfLife > 0 {
+				metric.NodeResourceOccupancyEWMA.WithLabelValues(labels...).Set(round(curr.updateEWMA(prev, resource, percent, now, occupancyEWMAHalfLife)))
 			}
-			metric.NodeResourceLimits.WithLabelValues(labels...).Set(val)
+			curr.occupancy[resource] = percent
+			if prev != nil && occupancyAlertDelta > 0 {
+				if prevOcc, ok := prev.occupancy[resource]; ok && math.Abs(percent-prevOcc) > occupancyAlertDelta {
+					log.InfoS("Occupancy swing", "node", node.Name, "resource", resource, "old", prevOcc, "new", percent)
+				}
+			}
+			cluster.addOccupancy(node.Name, resourceLabel, percent)
+			if pool, ok := node.Labels[poolLabel]; ok && poolLabel != "" {
+				cluster.addPoolOccupancy(pool, resourceLabel, percent)
+			}
+			metric.NodeResourceScore.WithLabelValues(scoreLabels...).Set(round(score))
+			if stats, ok := s.scores.Stats(resource); ok {
+				metric.NodeResourceScoreSamples.WithLabelValues(scoreLabels...).Set(float64(stats.Samples))
+				metric.NodeResourceScoreSum.WithLabelValues(scoreLabels...).Set(stats.Total)
+				metric.NodeResourceScoreWeight.WithLabelValues(scoreLabels...).Set(stats.Weight)
+			}
+		}
+	}
+	metric.NodeActiveResourceCount.WithLabelValues(nodeOnlyLabels...).Set(float64(active))
+	// the raw amounts, as the ratio of scaled units would mean nothing
+	if cpu := usage.requests.Cpu().AsApproximateFloat64(); cpu > 0 {
+		metric.NodeMemoryPerCPURequested.WithLabelValues(nodeOnlyLabels...).Set(round(usage.requests.Memory().AsApproximateFloat64() / cpu))
+	}
+	if cluster.unscheduled != nil {
+		fits := 0.0
+		if fitsLargestRequest {
+			fits = 1
 		}
+		metric.NodeFitsLargestRequest.WithLabelValues(nodeOnlyLabels...).Set(fits)
 	}
 }
 
-func addResourceList(total, addition corev1.ResourceList) {
-	for resourceName, quantity := range addition {
-		if curr, found := total[resourceName]; found {
-			curr.Add(quantity)
-			total[resourceName] = curr
-		} else {
-			total[resourceName] = quantity.DeepCopy()
-		}
+// round rounds the value to -round-digits decimal places, if set.
+func round(v float64) float64 {
+	if roundDigits < 0 {
+		return v
 	}
+	return roundTo(v, roundDigits)
+}
+
+// roundTo rounds the value to the given number of decimal places.
+func roundTo(v float64, digits int) float64 {
+	p := math.Pow(10, float64(digits))
+	return math.Round(v*p) / p
+}
+
+// validAmount reports whether the amount of the resource in the list, if
+// any, is finite and non-negative, logging and counting it otherwise.
+func (s *sampler) validAmount(nodeName, resource, kind string, list corev1.ResourceList) bool {
+	quantity, ok := list[corev1.ResourceName(resource)]
+	if !ok {
+		return true
+	}
+	// NaN fails any comparison
+	if v := quantityValue(resource, quantity); v >= 0 && !math.IsInf(v, 0) {
+		return true
+	}
+	log.Infof("ERROR: ignoring the invalid %s %s of %s on node %s", kind, quantity.String(), resource, nodeName)
+	s.metric.InvalidValues.WithLabelValues(resource).Inc()
+	return false
+}
+
+// getQuantity returns the approximate value of the resource in the list, or 0 if missing.
+func getQuantity(list corev1.ResourceList, resource string) float64 {
+	if v, ok := list[corev1.ResourceName(resource)]; ok {
+		return quantityValue(resource, v)
+	}
+	return 0
+
 }
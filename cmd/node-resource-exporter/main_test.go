@@ -0,0 +1,626 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/oklog/run"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/dmitsh/node-resource-exporter/pkg/metrics"
+)
+
+// setFlag sets the flag variable for the duration of the test.
+func setFlag[T any](t *testing.T, v *T, value T) {
+	t.Helper()
+	old := *v
+	*v = value
+	t.Cleanup(func() { *v = old })
+}
+
+// resourceList returns the list of the name, quantity pairs.
+func resourceList(pairs ...string) corev1.ResourceList {
+	list := corev1.ResourceList{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		list[corev1.ResourceName(pairs[i])] = resource.MustParse(pairs[i+1])
+	}
+	return list
+}
+
+// gatherSeries returns the value of each series of the metric of the
+// sampler, by its label pairs, e.g. `node="a",resource="cpu"`, in label name
+// order.
+func gatherSeries(t *testing.T, s *sampler, name string) map[string]float64 {
+	t.Helper()
+	families, err := s.reg.(prometheus.Gatherer).Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics: %v", err)
+	}
+	series := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			pairs := make([]string, 0, len(m.GetLabel()))
+			for _, label := range m.GetLabel() {
+				pairs = append(pairs, label.GetName()+"="+`"`+label.GetValue()+`"`)
+			}
+			value := m.GetGauge().GetValue()
+			if m.Counter != nil {
+				value = m.GetCounter().GetValue()
+			}
+			series[strings.Join(pairs, ",")] = value
+		}
+	}
+	return series
+}
+
+// reportTestNodes runs a pass of the sampler over the nodes and pods, listed
+// per node, and publishes its snapshot.
+func reportTestNodes(t *testing.T, s *sampler, nodes []corev1.Node, resources []string, pods ...runtime.Object) {
+	t.Helper()
+	usages := listNodeUsagePerNode(context.Background(), newFakeClient(pods...), nodes, nil)
+	s.reportNodes(nodes, usages, resources, newClusterUsage())
+}
+
+func TestReportNodeUsageLabels(t *testing.T) {
+	setFlag(t, &nodeLabelKey, "node")
+	setFlag(t, &nodeLabelKeys, []string{"zone"})
+	setFlag(t, &occupancyBasis, basisAllocatable)
+	setFlag(t, &emitQuantityInfo, true)
+	setFlag(t, &roundDigits, -1)
+
+	allocatable := resourceList("cpu", "4", "memory", "8Gi")
+	nodes := []corev1.Node{newNode("node-a", allocatable), newNode("node-b", allocatable)}
+	nodes[0].Labels = map[string]string{"zone": "zone-a"}
+	nodes[1].Labels = map[string]string{"zone": "zone-b"}
+	s := newTestSampler(t, newFakeClient())
+	reportTestNodes(t, s, nodes, []string{"cpu", "memory"},
+		newPod("a1", "node-a", corev1.PodRunning, newContainer("c", resourceList("cpu", "1", "memory", "1Gi"), nil)),
+		newPod("b1", "node-b", corev1.PodRunning, newContainer("c", resourceList("cpu", "3", "memory", "2Gi"), nil)))
+
+	// each resource of each node keeps its own label values, although
+	// they share a slice overwritten for each resource
+	want := map[string]map[string]float64{
+		"node_resource_requests": {
+			`node="node-a",resource="cpu",zone="zone-a"`:    1,
+			`node="node-a",resource="memory",zone="zone-a"`: 1 << 30,
+			`node="node-b",resource="cpu",zone="zone-b"`:    3,
+			`node="node-b",resource="memory",zone="zone-b"`: 2 << 30,
+		},
+		"node_resource_requests_quantity": {
+			`node="node-a",quantity="1",resource="cpu",zone="zone-a"`:      1,
+			`node="node-a",quantity="1Gi",resource="memory",zone="zone-a"`: 1,
+			`node="node-b",quantity="3",resource="cpu",zone="zone-b"`:      1,
+			`node="node-b",quantity="2Gi",resource="memory",zone="zone-b"`: 1,
+		},
+		"node_resource_requests_cluster_fraction": {
+			`node="node-a",resource="cpu",zone="zone-a"`:    0.25,
+			`node="node-a",resource="memory",zone="zone-a"`: 1.0 / 3,
+			`node="node-b",resource="cpu",zone="zone-b"`:    0.75,
+			`node="node-b",resource="memory",zone="zone-b"`: 2.0 / 3,
+		},
+		"node_resource_occupancy": {
+			`node="node-a",resource="cpu",zone="zone-a"`:    25,
+			`node="node-a",resource="memory",zone="zone-a"`: 12.5,
+			`node="node-b",resource="cpu",zone="zone-b"`:    75,
+			`node="node-b",resource="memory",zone="zone-b"`: 25,
+		},
+		// the score of a resource averages the nodes reported so far
+		"node_resource_score": {
+			`resource="cpu",zone="zone-a"`:    25,
+			`resource="memory",zone="zone-a"`: 12.5,
+			`resource="cpu",zone="zone-b"`:    50,
+			`resource="memory",zone="zone-b"`: 18.75,
+		},
+	}
+	for name, wantSeries := range want {
+		got := gatherSeries(t, s, name)
+		if len(got) != len(wantSeries) {
+			t.Errorf("%s: series %v, want %v", name, got, wantSeries)
+			continue
+		}
+		for labels, value := range wantSeries {
+			if v, ok := got[labels]; !ok || v != value {
+				t.Errorf("%s{%s} = %v (present %v), want %v", name, labels, v, ok, value)
+			}
+		}
+	}
+}
+
+func TestReportNodeIdle(t *testing.T) {
+	setFlag(t, &nodeLabelKey, "node")
+	setFlag(t, &occupancyBasis, basisAllocatable)
+
+	requests := resourceList("cpu", "100m")
+	tests := []struct {
+		name       string
+		qosClasses map[corev1.PodQOSClass]bool
+		pods       []runtime.Object
+		want       float64
+	}{
+		{
+			name: "no pods",
+			want: 1,
+		},
+		{
+			name: "a running pod requesting cpu",
+			pods: []runtime.Object{newPod("p1", "node-a", corev1.PodRunning, newContainer("c", requests, nil))},
+		},
+		{
+			name: "running pods requesting nothing",
+			pods: []runtime.Object{newPod("p1", "node-a", corev1.PodRunning, newContainer("c", nil, nil))},
+			want: 1,
+		},
+		{
+			name: "completed pods requesting cpu",
+			pods: []runtime.Object{newPod("p1", "node-a", corev1.PodSucceeded, newContainer("c", requests, nil))},
+			want: 1,
+		},
+		{
+			name:       "running pods requesting cpu left out by the qos filter",
+			qosClasses: map[corev1.PodQOSClass]bool{corev1.PodQOSGuaranteed: true},
+			pods: []runtime.Object{
+				newPod("p1", "node-a", corev1.PodRunning, newContainer("c", requests, nil)),
+				newPod("p2", "node-a", corev1.PodRunning, newContainer("c", nil, nil)),
+			},
+			want: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, &qosClasses, tt.qosClasses)
+			s := newTestSampler(t, newFakeClient())
+			reportTestNodes(t, s, []corev1.Node{newNode("node-a", resourceList("cpu", "1"))}, []string{"cpu"}, tt.pods...)
+			if got := gatherSeries(t, s, "node_idle")[`node="node-a"`]; got != tt.want {
+				t.Errorf("node_idle %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCPUOccupancyDigits(t *testing.T) {
+	setFlag(t, &nodeLabelKey, "node")
+	setFlag(t, &occupancyBasis, basisAllocatable)
+	setFlag(t, &roundDigits, -1)
+
+	tests := []struct {
+		name   string
+		digits int
+		want   float64
+	}{
+		{name: "rounding disabled keeps the float noise", digits: -1, want: 0.3 * 100},
+		{name: "rounded to 6 digits", digits: 6, want: 30},
+		{name: "rounded to units", digits: 0, want: 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, &cpuOccupancyDigits, tt.digits)
+			s := newTestSampler(t, newFakeClient())
+			reportTestNodes(t, s, []corev1.Node{newNode("node-a", resourceList("cpu", "1"))}, []string{"cpu"},
+				newPod("p1", "node-a", corev1.PodRunning, newContainer("c", resourceList("cpu", "300m"), nil)))
+			if got := gatherSeries(t, s, "node_resource_occupancy")[`node="node-a",resource="cpu"`]; got != tt.want {
+				t.Errorf("cpu occupancy %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidAmount(t *testing.T) {
+	tests := []struct {
+		name        string
+		list        corev1.ResourceList
+		want        bool
+		wantInvalid float64
+	}{
+		{name: "missing resource", list: resourceList("memory", "1Gi"), want: true},
+		{name: "valid amount", list: resourceList("cpu", "250m"), want: true},
+		{name: "zero amount", list: resourceList("cpu", "0"), want: true},
+		{name: "negative amount", list: resourceList("cpu", "-1"), wantInvalid: 1},
+		// the approximate float of a quantity beyond the float range is infinite
+		{name: "infinite amount", list: corev1.ResourceList{"cpu": *resource.NewScaledQuantity(1, 400)}, wantInvalid: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestSampler(t, newFakeClient())
+			if got := s.validAmount("node-a", "cpu", "requests", tt.list); got != tt.want {
+				t.Errorf("valid %v, want %v", got, tt.want)
+			}
+			if got := testutil.ToFloat64(s.metric.InvalidValues.WithLabelValues("cpu")); got != tt.wantInvalid {
+				t.Errorf("%v invalid values counted, want %v", got, tt.wantInvalid)
+			}
+		})
+	}
+}
+
+func TestReportEffectiveLimits(t *testing.T) {
+	setFlag(t, &nodeLabelKey, "node")
+	setFlag(t, &occupancyBasis, basisAllocatable)
+	cpu := func(amount string) corev1.ResourceList {
+		if len(amount) == 0 {
+			return nil
+		}
+		return resourceList("cpu", amount)
+	}
+	value := func(amount string) float64 {
+		q := resource.MustParse(amount)
+		return q.AsApproximateFloat64()
+	}
+
+	// the node allocatable is 4 cpu
+	tests := []struct {
+		name              string
+		requests, limits  string
+		podLimits         string
+		wantRequests      string
+		wantLimits        string
+		wantDefaulted     string
+		wantEffective     string
+		wantUnboundedPods float64
+	}{
+		{name: "neither requests nor limits", wantRequests: "0", wantDefaulted: "0", wantLimits: "0", wantEffective: "4", wantUnboundedPods: 1},
+		{name: "requests only", requests: "1", wantRequests: "1", wantDefaulted: "1", wantLimits: "0", wantEffective: "4", wantUnboundedPods: 1},
+		{name: "limits only", limits: "2", wantRequests: "0", wantDefaulted: "2", wantLimits: "2", wantEffective: "2"},
+		{name: "requests and limits", requests: "1", limits: "2", wantRequests: "1", wantDefaulted: "1", wantLimits: "2", wantEffective: "2"},
+		{name: "pod-level limits", requests: "1", podLimits: "3", wantRequests: "1", wantDefaulted: "1", wantLimits: "3", wantEffective: "3"},
+	}
+	for _, tt := range tests {
+		for _, mode := range []struct {
+			defaultRequests, effective bool
+		}{{false, false}, {true, false}, {false, true}, {true, true}} {
+			t.Run(fmt.Sprintf("%s default requests %v effective limits %v", tt.name, mode.defaultRequests, mode.effective), func(t *testing.T) {
+				setFlag(t, &defaultRequestToLimit, mode.defaultRequests)
+				setFlag(t, &effectiveLimits, mode.effective)
+				pod := newPod("p1", "node-a", corev1.PodRunning, newContainer("c", cpu(tt.requests), cpu(tt.limits)))
+				if len(tt.podLimits) != 0 {
+					withPodResources(pod, nil, cpu(tt.podLimits))
+				}
+				s := newTestSampler(t, newFakeClient())
+				reportTestNodes(t, s, []corev1.Node{newNode("node-a", resourceList("cpu", "4"))}, []string{"cpu"}, pod)
+
+				wantRequests, wantLimits, wantUnbounded := tt.wantRequests, tt.wantLimits, 0.0
+				if mode.defaultRequests {
+					wantRequests = tt.wantDefaulted
+				}
+				if mode.effective {
+					wantLimits, wantUnbounded = tt.wantEffective, tt.wantUnboundedPods
+				}
+				series := `node="node-a",resource="cpu"`
+				if got, want := gatherSeries(t, s, "node_resource_requests")[series], value(wantRequests); got != want {
+					t.Errorf("cpu requests %v, want %v", got, want)
+				}
+				if got, want := gatherSeries(t, s, "node_resource_limits")[series], value(wantLimits); got != want {
+					t.Errorf("cpu limits %v, want %v", got, want)
+				}
+				usage := newNodeUsage(nil)
+				usage.addPod(pod)
+				if got := float64(usage.unboundedPods["cpu"]); got != wantUnbounded {
+					t.Errorf("%v unbounded pods, want %v", got, wantUnbounded)
+				}
+			})
+		}
+	}
+}
+
+// setDemoFlags sets the flags of the demo mode to their defaults for the
+// duration of the test, along with the globals mainInternal derives from the
+// flags.
+func setDemoFlags(t *testing.T) {
+	t.Helper()
+	setFlag(t, &demo, true)
+	setFlag(t, &resources, "cpu")
+	setFlag(t, &port, 0)
+	setFlag(t, &metricsPath, "/metrics")
+	setFlag(t, &listStrategy, listPerNode)
+	setFlag(t, &labelsMode, labelsSeparate)
+	setFlag(t, &nodeLabelKey, "node")
+	setFlag(t, &occupancyBasis, basisAllocatable)
+	setFlag(t, &occupancyFrom, occupancyFromRequests)
+	setFlag(t, &limitsAggregation, limitsSum)
+	setFlag(t, &cpuUnit, cpuCores)
+	setFlag(t, &shutdownTimeout, time.Second)
+	setFlag(t, &kubeQPS, 5)
+	setFlag(t, &kubeBurst, 10)
+	setFlag(t, &shardTotal, 1)
+
+	setFlag(t, &trackedResourceNames, nil)
+	setFlag(t, &excludedResources, nil)
+	setFlag(t, &nodeLabelKeys, nil)
+	setFlag(t, &nodeNames, nil)
+	setFlag(t, &labelValueAllowlist, nil)
+	setFlag(t, &qosClasses, nil)
+	setFlag(t, &excludedContainerNames, nil)
+	setFlag(t, &resourceAliases, nil)
+	setFlag(t, &resourceScales, nil)
+	setFlag(t, &resourceIntervals, nil)
+	setFlag(t, &occupancyCritical, nil)
+	setFlag(t, &occupancyBases, nil)
+	setFlag(t, &occupancyQuantiles, nil)
+	setFlag(t, &occupancySummaryObjectives, nil)
+	t.Cleanup(func() { shuttingDown.Store(false) })
+}
+
+func TestMainInternalSIGTERM(t *testing.T) {
+	setDemoFlags(t)
+	// keep SIGTERM from killing the test before the run group handles it
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGTERM)
+	defer signal.Stop(sigterm)
+
+	done := make(chan error, 1)
+	go func() { done <- mainInternal() }()
+	// the signal is missed until the run group starts its signal handler
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case err := <-done:
+			var signalErr run.SignalError
+			if !errors.As(err, &signalErr) || signalErr.Signal != syscall.SIGTERM {
+				t.Fatalf("mainInternal error %v, want a SIGTERM run.SignalError", err)
+			}
+			if code := exitCode(err); code != 0 {
+				t.Errorf("exit code %d on SIGTERM, want 0", code)
+			}
+			return
+		case <-ticker.C:
+			if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+				t.Fatalf("sending SIGTERM: %v", err)
+			}
+		case <-timeout:
+			t.Fatal("mainInternal still running 10s after SIGTERM")
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "no error"},
+		{name: "stop signal", err: fmt.Errorf("run group: %w", run.SignalError{Signal: syscall.SIGTERM})},
+		{name: "configuration error", err: &exitError{code: exitCodeConfig, err: errors.New("address in use")}, want: exitCodeConfig},
+		{name: "runtime error", err: errors.New("first sampling pass failed"), want: 1},
+	}
+	for _, tt := range tests {
+		if got := exitCode(tt.err); got != tt.want {
+			t.Errorf("%s: exit code %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestShutdownServerTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	setFlag(t, &shutdownTimeout, timeout)
+	t.Cleanup(func() { shuttingDown.Store(false) })
+
+	entered, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+	})}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	go func() { _ = serve(server, listener) }()
+	defer server.Close()
+	go func() {
+		if resp, err := http.Get("http://" + listener.Addr().String()); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-entered
+
+	start := time.Now()
+	err = shutdownServer(server)
+	elapsed := time.Since(start)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("shutdown error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed < timeout || elapsed > timeout+time.Second {
+		t.Errorf("shutdown returned after %v, want about %v", elapsed, timeout)
+	}
+}
+
+func TestReportNodesWithoutAllocatable(t *testing.T) {
+	setFlag(t, &nodeLabelKey, "node")
+	setFlag(t, &occupancyBasis, basisAllocatable)
+
+	// a registering node has a nil allocatable list yet
+	nodes := []corev1.Node{newNode("node-a", resourceList("cpu", "1")), newNode("node-new", nil)}
+	s := newTestSampler(t, newFakeClient())
+	reportTestNodes(t, s, nodes, []string{"cpu"},
+		newPod("a1", "node-a", corev1.PodRunning, newContainer("c", resourceList("cpu", "100m"), nil)),
+		newPod("n1", "node-new", corev1.PodRunning, newContainer("c", resourceList("cpu", "100m"), nil)))
+
+	if got := gatherSeries(t, s, "node_resource_exporter_nodes_not_ready_for_metrics")[""]; got != 1 {
+		t.Errorf("%v nodes not ready for metrics, want 1", got)
+	}
+	for _, name := range []string{"node_resource_requests", "node_resource_occupancy", "node_resource_allocatable"} {
+		series := gatherSeries(t, s, name)
+		if _, ok := series[`node="node-a",resource="cpu"`]; !ok {
+			t.Errorf("%s: no series of the ready node in %v", name, series)
+		}
+		if _, ok := series[`node="node-new",resource="cpu"`]; ok {
+			t.Errorf("%s: series of the node without allocatable resources in %v", name, series)
+		}
+	}
+}
+
+func TestParseList(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  []string
+	}{
+		{name: "empty", value: "", want: nil},
+		{name: "single entry", value: "cpu", want: []string{"cpu"}},
+		{name: "distinct entries", value: "memory,cpu", want: []string{"memory", "cpu"}},
+		{name: "repeated entry", value: "cpu,cpu,memory", want: []string{"cpu", "memory"}},
+		{name: "repeats keep the first position", value: "memory,cpu,memory,cpu,pods", want: []string{"memory", "cpu", "pods"}},
+		{name: "surrounding whitespace", value: " cpu , memory ", want: []string{"cpu", "memory"}},
+		{name: "empty entries", value: "cpu,,memory", want: []string{"cpu", "memory"}},
+		{name: "only separators", value: " , ,", want: nil},
+		{name: "repeat after trimming", value: "cpu, cpu", want: []string{"cpu"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseList(tt.value, "-r"); !slices.Equal(got, tt.want) {
+				t.Errorf("parseList(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+// withQOSClass returns the pod of the QoS class.
+func withQOSClass(pod *corev1.Pod, class corev1.PodQOSClass) *corev1.Pod {
+	pod.Status.QOSClass = class
+	return pod
+}
+
+func TestReportQOSFilter(t *testing.T) {
+	setFlag(t, &nodeLabelKey, "node")
+	setFlag(t, &occupancyBasis, basisAllocatable)
+	pods := []runtime.Object{
+		withQOSClass(newPod("guaranteed", "node-a", corev1.PodRunning,
+			newContainer("c", resourceList("cpu", "1"), resourceList("cpu", "1"))), corev1.PodQOSGuaranteed),
+		withQOSClass(newPod("burstable", "node-a", corev1.PodRunning,
+			newContainer("c", resourceList("cpu", "500m"), resourceList("cpu", "2"))), corev1.PodQOSBurstable),
+		withQOSClass(newPod("besteffort", "node-a", corev1.PodRunning, newContainer("c", nil, nil)), corev1.PodQOSBestEffort),
+	}
+
+	tests := []struct {
+		name        string
+		classes     []corev1.PodQOSClass
+		wantReq     float64
+		wantLim     float64
+		wantSkipped float64
+	}{
+		{name: "all classes", wantReq: 1.5, wantLim: 3},
+		{name: "guaranteed", classes: []corev1.PodQOSClass{corev1.PodQOSGuaranteed}, wantReq: 1, wantLim: 1, wantSkipped: 2},
+		{name: "burstable", classes: []corev1.PodQOSClass{corev1.PodQOSBurstable}, wantReq: 0.5, wantLim: 2, wantSkipped: 2},
+		{name: "best effort", classes: []corev1.PodQOSClass{corev1.PodQOSBestEffort}, wantSkipped: 2},
+		{
+			name:        "guaranteed and burstable",
+			classes:     []corev1.PodQOSClass{corev1.PodQOSGuaranteed, corev1.PodQOSBurstable},
+			wantReq:     1.5,
+			wantLim:     3,
+			wantSkipped: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			classes := make(map[corev1.PodQOSClass]bool)
+			for _, class := range tt.classes {
+				classes[class] = true
+			}
+			setFlag(t, &qosClasses, classes)
+			s := newTestSampler(t, newFakeClient())
+			reportTestNodes(t, s, []corev1.Node{newNode("node-a", resourceList("cpu", "4"))}, []string{"cpu"}, pods...)
+
+			series := `node="node-a",resource="cpu"`
+			if got := gatherSeries(t, s, "node_resource_requests")[series]; got != tt.wantReq {
+				t.Errorf("cpu requests %v, want %v", got, tt.wantReq)
+			}
+			if got := gatherSeries(t, s, "node_resource_limits")[series]; got != tt.wantLim {
+				t.Errorf("cpu limits %v, want %v", got, tt.wantLim)
+			}
+			if got := gatherSeries(t, s, "node_pods_skipped")[`node="node-a",reason="qos"`]; got != tt.wantSkipped {
+				t.Errorf("%v pods skipped by QoS class, want %v", got, tt.wantSkipped)
+			}
+		})
+	}
+}
+
+func TestReportPodDensity(t *testing.T) {
+	setFlag(t, &nodeLabelKey, "node")
+	setFlag(t, &occupancyBasis, basisAllocatable)
+
+	allocatable := resourceList("cpu", "4")
+	nodes := []corev1.Node{newNode("node-a", allocatable), newNode("node-b", allocatable)}
+	requests := resourceList("cpu", "100m")
+	s := newTestSampler(t, newFakeClient())
+	s.metric.EnablePodDensityHistogram(s.reg)
+	reportTestNodes(t, s, nodes, []string{"cpu"},
+		newPod("a1", "node-a", corev1.PodRunning, newContainer("c", requests, nil)),
+		newPod("b1", "node-b", corev1.PodRunning, newContainer("c", requests, nil)),
+		newPod("b2", "node-b", corev1.PodRunning, newContainer("c", requests, nil)),
+		newPod("b3", "node-b", corev1.PodPending, newContainer("c", requests, nil)))
+
+	families, err := s.reg.(prometheus.Gatherer).Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics: %v", err)
+	}
+	i := slices.IndexFunc(families, func(family *dto.MetricFamily) bool { return family.GetName() == "node_pod_density" })
+	if i < 0 {
+		t.Fatal("no node_pod_density histogram")
+	}
+	histogram := families[i].GetMetric()[0].GetHistogram()
+	if histogram.GetSampleCount() != 2 || histogram.GetSampleSum() != 3 {
+		t.Errorf("%d nodes of %v running pods observed, want 2 nodes of 3 pods", histogram.GetSampleCount(), histogram.GetSampleSum())
+	}
+	// the pods fall into the native buckets only
+	if len(histogram.GetPositiveSpan()) == 0 || len(histogram.GetBucket()) != 0 {
+		t.Errorf("%d native bucket spans and %d classic buckets, want native buckets only", len(histogram.GetPositiveSpan()), len(histogram.GetBucket()))
+	}
+}
+
+func TestOccupancySummarySeries(t *testing.T) {
+	setFlag(t, &nodeLabelKey, "node")
+	setFlag(t, &nodeLabelKeys, []string{"zone"})
+	setFlag(t, &occupancyBasis, basisAllocatable)
+
+	allocatable := resourceList("cpu", "4")
+	nodeA, nodeB := newNode("node-a", allocatable), newNode("node-b", allocatable)
+	nodeA.Labels = map[string]string{"zone": "zone-a", "rack": "rack-a"}
+	nodeB.Labels = map[string]string{"zone": "zone-b"}
+	s := newTestSampler(t, newFakeClient())
+	s.metric.EnableOccupancySummary([]float64{0.5}, time.Minute)
+
+	wantSeries := func(want ...string) {
+		t.Helper()
+		series := gatherSeries(t, s, "node_resource_occupancy_summary")
+		if len(series) != len(want) {
+			t.Errorf("summary series %v, want %q", series, want)
+		}
+		for _, key := range want {
+			if _, ok := series[key]; !ok {
+				t.Errorf("no summary series {%s} in %v", key, series)
+			}
+		}
+	}
+	reportTestNodes(t, s, []corev1.Node{nodeA, nodeB}, []string{"cpu"})
+	wantSeries(`node="node-a",resource="cpu",zone="zone-a"`, `node="node-b",resource="cpu",zone="zone-b"`)
+
+	// node-b is removed and node-a moves to another zone
+	nodeA.Labels["zone"] = "zone-c"
+	reportTestNodes(t, s, []corev1.Node{nodeA}, []string{"cpu"})
+	wantSeries(`node="node-a",resource="cpu",zone="zone-c"`)
+
+	// a reload changes the node labels
+	setFlag(t, &nodeLabelKeys, []string{"rack"})
+	metrics.New(s.reg, nodeLabelKey, nodeLabelNames(), nil)
+	reportTestNodes(t, s, []corev1.Node{nodeA}, []string{"cpu"})
+	wantSeries(`node="node-a",rack="rack-a",resource="cpu"`)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"hash/fnv"
+	"slices"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	log "k8s.io/klog/v2"
+)
+
+// selectNodes returns the nodes processed by this exporter instance, that is
+// the nodes of its shard, among those named by -nodes if set, without the
+// control-plane nodes with -exclude-control-plane, capped to the first
+// -max-nodes by name.
+func selectNodes(nodes []corev1.Node) []corev1.Node {
+	selected := make([]corev1.Node, 0, len(nodes))
+	for i := range nodes {
+		if excludeControlPlane && isControlPlane(&nodes[i]) {
+			continue
+		}
+		if (len(nodeNames) == 0 || nodeNames[nodes[i].Name]) && inShard(nodes[i].Name) {
+			selected = append(selected, nodes[i])
+		}
+	}
+	if maxNodes > 0 && len(selected) > maxNodes {
+		log.Infof("Processing %d of %d nodes, capped by -max-nodes", maxNodes, len(selected))
+		sort.Slice(selected, func(i, j int) bool { return selected[i].Name < selected[j].Name })
+		selected = selected[:maxNodes]
+	}
+	return selected
+}
+
+// isControlPlane reports whether the node has the -control-plane-label.
+func isControlPlane(node *corev1.Node) bool {
+	_, ok := node.Labels[controlPlaneLabel]
+	return ok
+}
+
+// unusedLabelKeys returns the -l node labels none of the nodes has.
+func unusedLabelKeys(nodes []corev1.Node) []string {
+	var unused []string
+	for _, key := range nodeLabelKeys {
+		found := false
+		for i := range nodes {
+			if _, found = nodes[i].Labels[key]; found {
+				break
+			}
+		}
+		if !found {
+			unused = append(unused, key)
+		}
+	}
+	return unused
+}
+
+type listedNode struct {
+	node  corev1.Node
+	usage *nodeUsage
+	seen  time.Time
+}
+
+// retainMissingNodes records the nodes listed by the pass with their usage,
+// and returns them along with the last listing of the nodes missing from the
+// pass for less than the -stale-grace-period, so that a node briefly missing
+// from the list keeps its series instead of flapping.
+func (s *sampler) retainMissingNodes(nodes []corev1.Node, usages []*nodeUsage, now time.Time) ([]corev1.Node, []*nodeUsage) {
+	listed := make(map[string]bool, len(nodes))
+	for i := range nodes {
+		listed[nodes[i].Name] = true
+		if usages[i] != nil {
+			s.lastListed[nodes[i].Name] = listedNode{node: nodes[i], usage: usages[i], seen: now}
+		}
+	}
+	nodes, usages = slices.Clip(nodes), slices.Clip(usages)
+	for name, last := range s.lastListed {
+		switch {
+		case listed[name]:
+		case now.Sub(last.seen) < staleGracePeriod:
+			nodes = append(nodes, last.node)
+			usages = append(usages, last.usage)
+		default:
+			delete(s.lastListed, name)
+		}
+	}
+	return nodes, usages
+}
+
+// advertisedResources returns the resources in the allocatable of any of the nodes.
+func advertisedResources(nodes []corev1.Node) map[corev1.ResourceName]bool {
+	advertised := make(map[corev1.ResourceName]bool)
+	for i := range nodes {
+		for name, v := range nodes[i].Status.Allocatable {
+			if !v.IsZero() {
+				advertised[name] = true
+			}
+		}
+	}
+	return advertised
+}
+
+// inShard reports whether the node belongs to the shard set by -shard and -shard-total.
+func inShard(nodeName string) bool {
+	if shardTotal <= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(nodeName))
+	return int(h.Sum32()%uint32(shardTotal)) == shard
+}
+
+// isNodeReady reports whether the Ready condition of the node is True.
+func isNodeReady(node *corev1.Node) bool {
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == corev1.NodeReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	prombridge "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	log "k8s.io/klog/v2"
+)
+
+// otlpShutdownTimeout bounds the final push of the OTLP exporter on shutdown.
+const otlpShutdownTimeout = 5 * time.Second
+
+// startOTLPExporter periodically pushes the gauges of the current snapshots
+// of the samplers to the OTLP endpoint until the context is canceled.
+func startOTLPExporter(ctx context.Context, samplers []*sampler) error {
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Infof("ERROR: OTLP exporter: %v", err)
+	}))
+
+	opts := []otlpmetricgrpc.Option{otlpmetricgrpc.WithEndpoint(otlpEndpoint)}
+	if otlpInsecure {
+		opts = append(opts, otlpmetricgrpc.WithInsecure())
+	}
+	exporter, err := otlpmetricgrpc.New(ctx, opts...)
+	if err != nil {
+		return err
+	}
+
+	gatherers := make(prometheus.Gatherers, len(samplers))
+	for i, s := range samplers {
+		gatherers[i] = s.metric.Gatherer(s.labels())
+	}
+	reader := sdkmetric.NewPeriodicReader(exporter,
+		sdkmetric.WithInterval(samplingInterval),
+		sdkmetric.WithProducer(prombridge.NewMetricProducer(prombridge.WithGatherer(gatherers))))
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	<-ctx.Done()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), otlpShutdownTimeout)
+	defer cancel()
+	if err := provider.Shutdown(shutdownCtx); err != nil {
+		log.Infof("ERROR: OTLP exporter shutdown: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "k8s.io/klog/v2"
+)
+
+// startFileWriter periodically writes the metrics gathered like those of the
+// metrics endpoint to the -output-file until the context is canceled. Each
+// write goes to a temporary file renamed over the output file, so that its
+// readers never see a partial exposition.
+func startFileWriter(ctx context.Context, g prometheus.Gatherer) error {
+	defer log.Infof("Exited file writer")
+	ticker := time.NewTicker(samplingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := prometheus.WriteToTextfile(outputFile, g); err != nil {
+				log.Infof("ERROR: failed to write the metrics to %s: %v", outputFile, err)
+			}
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
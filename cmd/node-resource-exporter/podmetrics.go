@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	metricsclient "k8s.io/metrics/pkg/client/clientset/versioned"
+)
+
+// podUsageIndex maps pods to their resource usage reported by the metrics server.
+type podUsageIndex map[types.NamespacedName]corev1.ResourceList
+
+// listPodUsage returns the usage of all pods, or nil if the metrics server is not queried.
+func listPodUsage(ctx context.Context, metricsClient metricsclient.Interface) (podUsageIndex, error) {
+	if metricsClient == nil {
+		return nil, nil
+	}
+
+	podMetrics, err := metricsClient.MetricsV1beta1().PodMetricses("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	index := make(podUsageIndex, len(podMetrics.Items))
+	for _, pm := range podMetrics.Items {
+		usage := corev1.ResourceList{}
+		for _, container := range pm.Containers {
+			addResourceList(usage, container.Usage)
+		}
+		index[types.NamespacedName{Namespace: pm.Namespace, Name: pm.Name}] = usage
+	}
+	return index, nil
+}
+
+// exceedsRequests reports whether the pod uses more cpu or memory than it requests.
+func exceedsRequests(usage, requests corev1.ResourceList) bool {
+	for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+		used, ok := usage[name]
+		if !ok {
+			continue
+		}
+		if requested, ok := requests[name]; ok && used.Cmp(requested) > 0 {
+			return true
+		}
+	}
+	return false
+}
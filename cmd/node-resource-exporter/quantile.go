@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+
+	"github.com/dmitsh/node-resource-exporter/pkg/metrics"
+)
+
+// occupancyWindow keeps the node occupancies of each resource over the last
+// -occupancy-quantile-window sampling passes, to report their quantiles.
+type occupancyWindow struct {
+	// passes is a ring of the occupancy percentages of the nodes of each
+	// pass, by resource, next being the slot of the next pass
+	passes []map[string][]float64
+	next   int
+}
+
+func newOccupancyWindow(size int) *occupancyWindow {
+	return &occupancyWindow{passes: make([]map[string][]float64, size)}
+}
+
+// add records the occupancies of a pass, evicting those of the oldest pass
+// once the window is full.
+func (w *occupancyWindow) add(occupancies map[string][]float64) {
+	w.passes[w.next] = occupancies
+	w.next = (w.next + 1) % len(w.passes)
+}
+
+// report sets the -occupancy-quantiles of the occupancies of each resource
+// over the window.
+func (w *occupancyWindow) report(metric *metrics.Snapshot) {
+	values := make(map[string][]float64)
+	for _, pass := range w.passes {
+		for resource, occupancies := range pass {
+			values[resource] = append(values[resource], occupancies...)
+		}
+	}
+	for resource, occupancies := range values {
+		slices.Sort(occupancies)
+		for _, q := range occupancyQuantiles {
+			metric.ClusterResourceOccupancyQuantile.WithLabelValues(resource, strconv.FormatFloat(q, 'f', -1, 64)).Set(round(quantile(occupancies, q)))
+		}
+	}
+}
+
+// quantile returns the q-quantile of the sorted values, interpolated
+// linearly between the closest ranks.
+func quantile(sorted []float64, q float64) float64 {
+	rank := q * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	if lower+1 >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[lower] + (rank-float64(lower))*(sorted[lower+1]-sorted[lower])
+}
+
+// parseQuantiles parses the comma-separated quantiles of -occupancy-quantiles.
+func parseQuantiles(value, flagName string) ([]float64, error) {
+	var quantiles []float64
+	for _, entry := range parseList(value, flagName) {
+		q, err := strconv.ParseFloat(entry, 64)
+		if err != nil || q < 0 || q > 1 {
+			return nil, fmt.Errorf("invalid quantile %q, expected a number between 0 and 1", entry)
+		}
+		quantiles = append(quantiles, q)
+	}
+	return quantiles, nil
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	log "k8s.io/klog/v2"
+)
+
+// Occupancy bases.
+const (
+	basisAllocatable = "allocatable"
+	basisCapacity    = "capacity"
+)
+
+// Occupancy numerators.
+const (
+	occupancyFromRequests = "requests"
+	occupancyFromLimits   = "limits"
+)
+
+// Aggregations of the container limits of a pod.
+const (
+	limitsSum = "sum"
+	limitsMax = "max"
+)
+
+// Cpu units.
+const (
+	cpuCores      = "cores"
+	cpuMillicores = "millicores"
+)
+
+// quantityValue returns the amount of the resource in its reported unit,
+// converting cpu to millicores when set by -cpu-unit, and scaled by the
+// factor of the resource set by -resource-scale.
+func quantityValue(name string, v resource.Quantity) float64 {
+	value := v.AsApproximateFloat64()
+	if name == string(corev1.ResourceCPU) && cpuUnit == cpuMillicores {
+		value = float64(v.MilliValue())
+	}
+	if scale, ok := resourceScales[name]; ok {
+		value *= scale
+	}
+	return value
+}
+
+// parseResourceScales parses the -resource-scale pairs.
+func parseResourceScales(value string) (map[string]float64, error) {
+	scales := make(map[string]float64)
+	for _, pair := range parseList(value, "-resource-scale") {
+		resource, factor, ok := strings.Cut(pair, "=")
+		if !ok || len(resource) == 0 {
+			return nil, fmt.Errorf("invalid resource scale %q, expected resource=factor", pair)
+		}
+		scale, err := strconv.ParseFloat(factor, 64)
+		if err != nil || scale <= 0 || math.IsInf(scale, 0) {
+			return nil, fmt.Errorf("invalid resource scale %q, expected a positive factor", pair)
+		}
+		scales[resource] = scale
+	}
+	return scales, nil
+}
+
+// unitDivisors lists the units -units accepts by name, by their divisor of
+// the base unit of the resource, e.g. of bytes for memory.
+var unitDivisors = map[string]float64{
+	"KB":  1e3,
+	"MB":  1e6,
+	"GB":  1e9,
+	"TB":  1e12,
+	"KiB": 1 << 10,
+	"MiB": 1 << 20,
+	"GiB": 1 << 30,
+	"TiB": 1 << 40,
+}
+
+// parseUnits parses the -units pairs, resource=unit for a unit of
+// unitDivisors, or resource=divisor, into the divisor and the unit name of
+// each resource. The unit of a divisor missing from unitDivisors is named
+// after the divisor.
+func parseUnits(value string) (map[string]float64, map[string]string, error) {
+	divisors := make(map[string]float64)
+	names := make(map[string]string)
+	for _, pair := range parseList(value, "-units") {
+		resource, unit, ok := strings.Cut(pair, "=")
+		if !ok || len(resource) == 0 {
+			return nil, nil, fmt.Errorf("invalid unit %q, expected resource=unit or resource=divisor", pair)
+		}
+		divisor, known := unitDivisors[unit]
+		if !known {
+			var err error
+			divisor, err = strconv.ParseFloat(unit, 64)
+			if err != nil || divisor <= 0 || math.IsInf(divisor, 0) {
+				return nil, nil, fmt.Errorf("invalid unit %q, expected one of %s or a positive divisor", pair, strings.Join(unitNames(), ", "))
+			}
+			unit = "units of " + unit
+			for name, d := range unitDivisors {
+				if d == divisor {
+					unit = name
+				}
+			}
+		}
+		divisors[resource] = divisor
+		names[resource] = unit
+	}
+	return divisors, names, nil
+}
+
+// unitNames returns the sorted names of unitDivisors.
+func unitNames() []string {
+	names := make([]string, 0, len(unitDivisors))
+	for name := range unitDivisors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseOccupancyCritical parses the -occupancy-critical entries: resource=percent
+// pairs, or a single percent applying to the other resources, stored under "".
+func parseOccupancyCritical(value string) (map[string]float64, error) {
+	thresholds := make(map[string]float64)
+	for _, entry := range parseList(value, "-occupancy-critical") {
+		resource, percent, ok := strings.Cut(entry, "=")
+		if !ok {
+			resource, percent = "", entry
+		}
+		threshold, err := strconv.ParseFloat(percent, 64)
+		if (ok && len(resource) == 0) || err != nil || threshold < 0 || math.IsInf(threshold, 0) {
+			return nil, fmt.Errorf("invalid occupancy threshold %q, expected resource=percent or percent", entry)
+		}
+		thresholds[resource] = threshold
+	}
+	return thresholds, nil
+}
+
+// criticalOccupancy returns the -occupancy-critical threshold of the resource.
+func criticalOccupancy(resource string) (float64, bool) {
+	if threshold, ok := occupancyCritical[resource]; ok {
+		return threshold, true
+	}
+	threshold, ok := occupancyCritical[""]
+	return threshold, ok
+}
+
+// defaultResourceUnits are the units of the amounts of the well-known resources.
+var defaultResourceUnits = map[string]string{
+	string(corev1.ResourceCPU):              cpuCores,
+	string(corev1.ResourceMemory):           "bytes",
+	string(corev1.ResourceEphemeralStorage): "bytes",
+}
+
+// parseResourceUnits parses the -resource-units pairs on top of the defaults.
+func parseResourceUnits(value string) (map[string]string, error) {
+	units := make(map[string]string, len(defaultResourceUnits))
+	for resource, unit := range defaultResourceUnits {
+		units[resource] = unit
+	}
+	units[string(corev1.ResourceCPU)] = cpuUnit
+	for _, pair := range parseList(value, "-resource-units") {
+		resource, unit, ok := strings.Cut(pair, "=")
+		if !ok || len(resource) == 0 || len(unit) == 0 {
+			return nil, fmt.Errorf("invalid resource unit %q, expected resource=unit", pair)
+		}
+		units[resource] = unit
+	}
+	return units, nil
+}
+
+// autoDiscoverResources, passed as -r, tracks every resource allocatable on a node.
+const autoDiscoverResources = "*"
+
+// trackedResources returns the resources reported for the node, discovering
+// them from its allocatable resources in auto-discovery mode, without the
+// resources excluded by -exclude-resources.
+func trackedResources(node *corev1.Node, resources []string) []string {
+	if len(resources) == 1 && resources[0] == autoDiscoverResources {
+		resources = make([]string, 0, len(node.Status.Allocatable))
+		for name := range node.Status.Allocatable {
+			resources = append(resources, string(name))
+		}
+		sort.Strings(resources)
+	}
+	if len(excludedResources) == 0 {
+		return resources
+	}
+
+	filtered := make([]string, 0, len(resources))
+	for _, resource := range resources {
+		if !excludedResources[resource] {
+			filtered = append(filtered, resource)
+		}
+	}
+	return filtered
+}
+
+// parseOccupancyBases parses the -occupancy-basis-per-resource resource=basis pairs.
+func parseOccupancyBases(value string) (map[string]string, error) {
+	bases := make(map[string]string)
+	for _, pair := range parseList(value, "-occupancy-basis-per-resource") {
+		resource, basis, ok := strings.Cut(pair, "=")
+		if !ok || len(resource) == 0 || (basis != basisAllocatable && basis != basisCapacity) {
+			return nil, fmt.Errorf("invalid occupancy basis %q, expected resource=allocatable or resource=capacity", pair)
+		}
+		bases[resource] = basis
+	}
+	return bases, nil
+}
+
+// resourceBasis returns the -occupancy-basis-per-resource basis of the
+// resource, or the -occupancy-basis.
+func resourceBasis(resource string) string {
+	if basis, ok := occupancyBases[resource]; ok {
+		return basis
+	}
+	return occupancyBasis
+}
+
+// occupancyDenominator returns the amount of the node resource occupancy is
+// computed against, according to its basis, less the -headroom-fraction.
+func occupancyDenominator(node *corev1.Node, resource string) (float64, bool) {
+	basis := resourceBasis(resource)
+	list := node.Status.Allocatable
+	if basis == basisCapacity {
+		list = node.Status.Capacity
+	}
+	v, ok := list[corev1.ResourceName(resource)]
+	if !ok && basis == basisAllocatable && allocatableFallbackCapacity {
+		if v, ok = node.Status.Capacity[corev1.ResourceName(resource)]; ok {
+			log.Infof("Allocatable %s is missing on node %s, occupancy is computed against capacity", resource, node.Name)
+		}
+	}
+	if !ok {
+		if basis == basisCapacity {
+			log.Warningf("Capacity of %s is missing on node %s, occupancy is not reported", resource, node.Name)
+		}
+		return 0, false
+	}
+	return quantityValue(resource, v) * (1 - headroomFraction), true
+}
+
+// wellKnownResources lists the native resources of the nodes, whose names
+// an alias may not take.
+var wellKnownResources = []corev1.ResourceName{
+	corev1.ResourceCPU,
+	corev1.ResourceMemory,
+	corev1.ResourceEphemeralStorage,
+	corev1.ResourceStorage,
+	corev1.ResourcePods,
+}
+
+// parseResourceAliases parses the -resource-aliases pairs. An alias may not
+// be the name of another resource, tracked or well-known, as the series of
+// both would merge into the same resource label value.
+func parseResourceAliases(value string, tracked []string) (map[string]string, error) {
+	aliases := make(map[string]string)
+	aliased := make(map[string]string)
+	for _, pair := range parseList(value, "-resource-aliases") {
+		resource, alias, ok := strings.Cut(pair, "=")
+		if !ok || len(resource) == 0 || len(alias) == 0 {
+			return nil, fmt.Errorf("invalid resource alias %q, expected resource=alias", pair)
+		}
+		if alias != resource && (slices.Contains(tracked, alias) || slices.Contains(wellKnownResources, corev1.ResourceName(alias))) {
+			return nil, fmt.Errorf("alias %q of %s is the name of another resource", alias, resource)
+		}
+		if other, ok := aliased[alias]; ok && other != resource {
+			return nil, fmt.Errorf("alias %q is used for both %s and %s", alias, other, resource)
+		}
+		aliases[resource] = alias
+		aliased[alias] = resource
+	}
+	return aliases, nil
+}
+
+// isExtendedResource reports whether the resource is an extended resource,
+// advertised by device plugins or the operator, rather than a native one:
+// it is qualified by a domain other than kubernetes.io.
+func isExtendedResource(name corev1.ResourceName) bool {
+	domain, _, found := strings.Cut(string(name), "/")
+	return found && domain != "kubernetes.io" && !strings.HasSuffix(domain, ".kubernetes.io") &&
+		!strings.HasPrefix(string(name), corev1.DefaultResourceRequestsPrefix)
+}
+
+// resourceLabelValue returns the value of the resource label of the metrics of the resource.
+func resourceLabelValue(resource string) string {
+	if alias, ok := resourceAliases[resource]; ok {
+		return alias
+	}
+	return resource
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestOccupancyDenominatorMixedBases(t *testing.T) {
+	node := newNode("node-a", resourceList("cpu", "3500m", "ephemeral-storage", "90Gi", "nvidia.com/gpu", "8"))
+	node.Status.Capacity = resourceList("cpu", "4", "ephemeral-storage", "100Gi")
+
+	tests := []struct {
+		name     string
+		basis    string
+		bases    string
+		resource string
+		want     float64
+		wantOK   bool
+	}{
+		{name: "global allocatable", basis: basisAllocatable, bases: "ephemeral-storage=capacity", resource: "cpu", want: 3.5, wantOK: true},
+		{name: "per-resource capacity", basis: basisAllocatable, bases: "ephemeral-storage=capacity", resource: "ephemeral-storage", want: 100 << 30, wantOK: true},
+		{name: "global capacity", basis: basisCapacity, bases: "cpu=allocatable", resource: "ephemeral-storage", want: 100 << 30, wantOK: true},
+		{name: "per-resource allocatable", basis: basisCapacity, bases: "cpu=allocatable", resource: "cpu", want: 3.5, wantOK: true},
+		{name: "per-resource capacity missing", basis: basisAllocatable, bases: "nvidia.com/gpu=capacity", resource: "nvidia.com/gpu"},
+		{name: "global allocatable of another resource", basis: basisAllocatable, bases: "nvidia.com/gpu=capacity", resource: "ephemeral-storage", want: 90 << 30, wantOK: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bases, err := parseOccupancyBases(tt.bases)
+			if err != nil {
+				t.Fatalf("parsing %q: %v", tt.bases, err)
+			}
+			setFlag(t, &occupancyBasis, tt.basis)
+			setFlag(t, &occupancyBases, bases)
+			got, ok := occupancyDenominator(&node, tt.resource)
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("denominator %v (ok %v), want %v (ok %v)", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestParseOccupancyBases(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{value: "", want: map[string]string{}},
+		{value: "ephemeral-storage=capacity, cpu=allocatable", want: map[string]string{"ephemeral-storage": basisCapacity, "cpu": basisAllocatable}},
+		{value: "ephemeral-storage", wantErr: true},
+		{value: "=capacity", wantErr: true},
+		{value: "cpu=requests", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseOccupancyBases(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: error %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !maps.Equal(got, tt.want) {
+			t.Errorf("%q: bases %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestReportOccupancyMixedBases(t *testing.T) {
+	setFlag(t, &nodeLabelKey, "node")
+	setFlag(t, &roundDigits, -1)
+	setFlag(t, &occupancyBasis, basisAllocatable)
+	setFlag(t, &occupancyBases, map[string]string{"ephemeral-storage": basisCapacity})
+
+	node := newNode("node-a", resourceList("cpu", "2", "ephemeral-storage", "80Gi"))
+	node.Status.Capacity = resourceList("cpu", "4", "ephemeral-storage", "100Gi")
+	s := newTestSampler(t, newFakeClient())
+	reportTestNodes(t, s, []corev1.Node{node}, []string{"cpu", "ephemeral-storage"},
+		newPod("p1", "node-a", corev1.PodRunning, newContainer("c", resourceList("cpu", "1", "ephemeral-storage", "40Gi"), nil)))
+
+	occupancy := gatherSeries(t, s, "node_resource_occupancy")
+	if got := occupancy[`node="node-a",resource="cpu"`]; got != 50 {
+		t.Errorf("cpu occupancy %v of allocatable, want 50", got)
+	}
+	if got := occupancy[`node="node-a",resource="ephemeral-storage"`]; got != 40 {
+		t.Errorf("ephemeral-storage occupancy %v of capacity, want 40", got)
+	}
+}
+
+func TestTrackedResources(t *testing.T) {
+	node := newNode("node-a", resourceList("cpu", "4", "memory", "8Gi", "pods", "110", "ephemeral-storage", "100Gi"))
+	tests := []struct {
+		name      string
+		resources []string
+		excluded  []string
+		want      []string
+	}{
+		{name: "wildcard", resources: []string{"*"}, want: []string{"cpu", "ephemeral-storage", "memory", "pods"}},
+		{name: "explicit includes", resources: []string{"memory", "cpu", "nvidia.com/gpu"}, want: []string{"memory", "cpu", "nvidia.com/gpu"}},
+		{name: "wildcard with excludes", resources: []string{"*"}, excluded: []string{"pods", "ephemeral-storage"}, want: []string{"cpu", "memory"}},
+		{name: "excluded explicit include", resources: []string{"cpu", "pods"}, excluded: []string{"pods"}, want: []string{"cpu"}},
+		{name: "excluded resource not tracked", resources: []string{"cpu"}, excluded: []string{"memory"}, want: []string{"cpu"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			excluded := make(map[string]bool)
+			for _, resource := range tt.excluded {
+				excluded[resource] = true
+			}
+			setFlag(t, &excludedResources, excluded)
+			if got := trackedResources(&node, tt.resources); !slices.Equal(got, tt.want) {
+				t.Errorf("tracked resources %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseResourceAliases(t *testing.T) {
+	tracked := []string{"cpu", "memory", "nvidia.com/gpu", "example.com/fpga"}
+	tests := []struct {
+		name    string
+		value   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "aliases", value: "memory=mem,nvidia.com/gpu=gpu", want: map[string]string{"memory": "mem", "nvidia.com/gpu": "gpu"}},
+		{name: "alias of itself", value: "cpu=cpu", want: map[string]string{"cpu": "cpu"}},
+		{name: "missing alias", value: "memory=", wantErr: true},
+		{name: "missing separator", value: "memory", wantErr: true},
+		{name: "alias of a tracked resource", value: "nvidia.com/gpu=example.com/fpga", wantErr: true},
+		{name: "alias of a well-known resource", value: "nvidia.com/gpu=memory", wantErr: true},
+		{name: "alias of a well-known resource not tracked", value: "nvidia.com/gpu=pods", wantErr: true},
+		{name: "alias of two resources", value: "nvidia.com/gpu=accel,example.com/fpga=accel", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseResourceAliases(tt.value, tracked)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !maps.Equal(got, tt.want) {
+				t.Errorf("aliases %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCPUMillicores(t *testing.T) {
+	setFlag(t, &nodeLabelKey, "node")
+	setFlag(t, &occupancyBasis, basisAllocatable)
+	setFlag(t, &roundDigits, -1)
+	setFlag(t, &cpuOccupancyDigits, -1)
+
+	tests := []struct {
+		unit            string
+		wantValue       float64
+		wantRequests    float64
+		wantAllocatable float64
+	}{
+		{unit: cpuCores, wantValue: 1.5, wantRequests: 1.5, wantAllocatable: 4},
+		{unit: cpuMillicores, wantValue: 1500, wantRequests: 1500, wantAllocatable: 4000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.unit, func(t *testing.T) {
+			setFlag(t, &cpuUnit, tt.unit)
+			if got := quantityValue("cpu", resource.MustParse("1500m")); got != tt.wantValue {
+				t.Errorf("1500m of cpu is %v, want %v", got, tt.wantValue)
+			}
+			// memory is in bytes whatever the cpu unit
+			if got := quantityValue("memory", resource.MustParse("1500m")); got != 1.5 {
+				t.Errorf("1500m of memory is %v, want 1.5", got)
+			}
+
+			s := newTestSampler(t, newFakeClient())
+			reportTestNodes(t, s, []corev1.Node{newNode("node-a", resourceList("cpu", "4"))}, []string{"cpu"},
+				newPod("p1", "node-a", corev1.PodRunning, newContainer("c", resourceList("cpu", "1500m"), nil)))
+			series := `node="node-a",resource="cpu"`
+			if got := gatherSeries(t, s, "node_resource_requests")[series]; got != tt.wantRequests {
+				t.Errorf("cpu requests %v, want %v", got, tt.wantRequests)
+			}
+			if got := gatherSeries(t, s, "node_resource_allocatable")[series]; got != tt.wantAllocatable {
+				t.Errorf("cpu allocatable %v, want %v", got, tt.wantAllocatable)
+			}
+			// the occupancy is a ratio of amounts of the same unit
+			if got := gatherSeries(t, s, "node_resource_occupancy")[series]; got != 37.5 {
+				t.Errorf("cpu occupancy %v, want 37.5", got)
+			}
+		})
+	}
+}
+
+func TestParseResourceScales(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		wantErr  bool
+		resource string
+		quantity string
+		want     float64
+	}{
+		{name: "scaled resource", value: "example.com/fpga=0.5", resource: "example.com/fpga", quantity: "4", want: 2},
+		{name: "scaled cpu", value: "cpu=1000, memory=2", resource: "cpu", quantity: "250m", want: 250},
+		{name: "resource not scaled", value: "cpu=1000", resource: "memory", quantity: "1Ki", want: 1024},
+		{name: "missing separator", value: "cpu", wantErr: true},
+		{name: "missing resource", value: "=2", wantErr: true},
+		{name: "bad factor", value: "cpu=two", wantErr: true},
+		{name: "zero factor", value: "cpu=0", wantErr: true},
+		{name: "negative factor", value: "cpu=-2", wantErr: true},
+		{name: "infinite factor", value: "cpu=+Inf", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scales, err := parseResourceScales(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			setFlag(t, &resourceScales, scales)
+			if got := quantityValue(tt.resource, resource.MustParse(tt.quantity)); got != tt.want {
+				t.Errorf("%s of %s is %v, want %v", tt.quantity, tt.resource, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseUnits(t *testing.T) {
+	tests := []struct {
+		name         string
+		value        string
+		wantErr      bool
+		wantDivisors map[string]float64
+		wantNames    map[string]string
+	}{
+		{name: "no units", wantDivisors: map[string]float64{}, wantNames: map[string]string{}},
+		{
+			name:         "cpu in cores",
+			value:        "cpu=1",
+			wantDivisors: map[string]float64{"cpu": 1},
+			wantNames:    map[string]string{"cpu": "units of 1"},
+		},
+		{
+			name:         "memory in GiB",
+			value:        "memory=GiB",
+			wantDivisors: map[string]float64{"memory": 1 << 30},
+			wantNames:    map[string]string{"memory": "GiB"},
+		},
+		{
+			name:         "divisor of a known unit",
+			value:        "memory=1073741824, ephemeral-storage=1e9",
+			wantDivisors: map[string]float64{"memory": 1 << 30, "ephemeral-storage": 1e9},
+			wantNames:    map[string]string{"memory": "GiB", "ephemeral-storage": "GB"},
+		},
+		{name: "unknown unit", value: "memory=PiB", wantErr: true},
+		{name: "unit of the wrong case", value: "memory=gib", wantErr: true},
+		{name: "missing separator", value: "memory", wantErr: true},
+		{name: "missing resource", value: "=GiB", wantErr: true},
+		{name: "zero divisor", value: "memory=0", wantErr: true},
+		{name: "negative divisor", value: "memory=-1024", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			divisors, names, err := parseUnits(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if !maps.Equal(divisors, tt.wantDivisors) || !maps.Equal(names, tt.wantNames) {
+				t.Errorf("divisors %v and names %v, want %v and %v", divisors, names, tt.wantDivisors, tt.wantNames)
+			}
+		})
+	}
+}
+
+func TestReportMemoryInGiB(t *testing.T) {
+	setFlag(t, &nodeLabelKey, "node")
+	setFlag(t, &occupancyBasis, basisAllocatable)
+	setFlag(t, &roundDigits, -1)
+
+	divisors, _, err := parseUnits("memory=GiB")
+	if err != nil {
+		t.Fatalf("parsing the units: %v", err)
+	}
+	setFlag(t, &resourceScales, map[string]float64{"memory": 1 / divisors["memory"]})
+
+	s := newTestSampler(t, newFakeClient())
+	reportTestNodes(t, s, []corev1.Node{newNode("node-a", resourceList("cpu", "4", "memory", "8Gi"))}, []string{"cpu", "memory"},
+		newPod("p1", "node-a", corev1.PodRunning, newContainer("c", resourceList("cpu", "1", "memory", "1536Mi"), resourceList("memory", "2Gi"))))
+	memory, cpu := `node="node-a",resource="memory"`, `node="node-a",resource="cpu"`
+	for _, tt := range []struct {
+		name   string
+		series string
+		want   float64
+	}{
+		{"node_resource_requests", memory, 1.5},
+		{"node_resource_limits", memory, 2},
+		{"node_resource_allocatable", memory, 8},
+		{"node_resource_occupancy", memory, 18.75},
+		// the other resources keep their unit
+		{"node_resource_requests", cpu, 1},
+		{"node_resource_allocatable", cpu, 4},
+	} {
+		if got := gatherSeries(t, s, tt.name)[tt.series]; got != tt.want {
+			t.Errorf("%s{%s} %v, want %v", tt.name, tt.series, got, tt.want)
+		}
+	}
+}
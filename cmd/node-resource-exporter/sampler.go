@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	metricsclient "k8s.io/metrics/pkg/client/clientset/versioned"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/dmitsh/node-resource-exporter/pkg/metrics"
+)
+
+// sampler samples the nodes of a cluster into its metrics. There is one
+// sampler per cluster passed by -kubeconfigs, or a single one otherwise.
+type sampler struct {
+	// cluster is the value of the cluster label, empty for a single cluster
+	cluster       string
+	kubeClient    kubernetes.Interface
+	metricsClient metricsclient.Interface
+	// reg is the registerer of the metrics, adding the cluster label if set
+	reg    prometheus.Registerer
+	metric *metrics.Metrics
+
+	// podLister serves the pods with -list-strategy=informer
+	podLister       corelisters.PodLister
+	podListerSynced cache.InformerSynced
+	// podWatch tells whether the pod informer is connected
+	podWatch *watchHealth
+
+	// passMu is held by the sampling pass in progress, see errPassInProgress
+	passMu sync.Mutex
+
+	// The following fields are only accessed by the sampling passes.
+
+	// histories holds the history of each node, keyed by node name
+	histories map[string]*nodeHistory
+	// lastNodeUpdate keeps the time of the last successful refresh of each node
+	lastNodeUpdate map[string]time.Time
+	scores         metrics.Scorer
+	// occupancies is nil unless -occupancy-quantile-window is set
+	occupancies *occupancyWindow
+	// lastPass is the time of the last pass which could list the nodes
+	lastPass time.Time
+	// unusedLabelKeys holds the node labels no node had on the last pass
+	unusedLabelKeys []string
+	// resourceSampled holds the time of the last pass sampling each resource
+	// of -resource-intervals, and heldUsages the node usages of this pass,
+	// keyed by resource and node name
+	resourceSampled map[string]time.Time
+	heldUsages      map[string]map[string]*nodeUsage
+	// lastListed holds the last listing of each node with its usage, to keep
+	// reporting the nodes missing from a pass for the -stale-grace-period
+	lastListed map[string]listedNode
+}
+
+func newSampler(cluster string, kubeClient kubernetes.Interface, metricsClient metricsclient.Interface, reg prometheus.Registerer, metric *metrics.Metrics) *sampler {
+	s := &sampler{
+		cluster:        cluster,
+		kubeClient:     kubeClient,
+		metricsClient:  metricsClient,
+		reg:            reg,
+		metric:         metric,
+		histories:      make(map[string]*nodeHistory),
+		lastNodeUpdate: make(map[string]time.Time),
+		scores:         newScorer(),
+
+		resourceSampled: make(map[string]time.Time),
+		heldUsages:      make(map[string]map[string]*nodeUsage),
+		lastListed:      make(map[string]listedNode),
+	}
+	if occupancyQuantileWindow > 0 {
+		s.occupancies = newOccupancyWindow(occupancyQuantileWindow)
+	}
+	return s
+}
+
+// errPassInProgress is returned by a sampling pass started while another one
+// of the same sampler is in progress, e.g. by the ticker and POST /sample.
+// The later pass is skipped, the one in progress publishing fresh metrics.
+var errPassInProgress = errors.New("a sampling pass is in progress")
+
+// labels returns the labels the sampler adds to its series.
+func (s *sampler) labels() prometheus.Labels {
+	if len(s.cluster) == 0 {
+		return nil
+	}
+	return prometheus.Labels{"cluster": s.cluster}
+}
+
+// newScorer returns the Scorer of -score-expr, or the default one.
+func newScorer() metrics.Scorer {
+	if scoreExpr != nil {
+		return scoreExpr.NewScorer(samplingInterval)
+	}
+	return metrics.NewResourceScore(samplingInterval)
+}
+
+// clusterSuffix returns the cluster of the sampler for the log lines.
+func (s *sampler) clusterSuffix() string {
+	if len(s.cluster) == 0 {
+		return ""
+	}
+	return " of cluster " + s.cluster
+}
+
+// kubeconfig is an entry of -kubeconfigs.
+type kubeconfig struct {
+	cluster string
+	path    string
+	context string
+}
+
+// parseKubeconfigs parses the comma-separated path[:context] entries of
+// -kubeconfigs. The cluster of an entry is named after its context, or after
+// the base name of its file without extension.
+func parseKubeconfigs(value string) ([]kubeconfig, error) {
+	var configs []kubeconfig
+	clusters := make(map[string]bool)
+	for _, entry := range parseList(value, "-kubeconfigs") {
+		path, context, _ := strings.Cut(entry, ":")
+		cluster := context
+		if len(cluster) == 0 {
+			cluster = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		}
+		if len(path) == 0 || len(cluster) == 0 {
+			return nil, fmt.Errorf("invalid kubeconfig %q", entry)
+		}
+		if clusters[cluster] {
+			return nil, fmt.Errorf("invalid kubeconfig %q, cluster %q is already defined", entry, cluster)
+		}
+		clusters[cluster] = true
+		configs = append(configs, kubeconfig{cluster: cluster, path: path, context: context})
+	}
+	return configs, nil
+}
+
+// restConfig loads the client config of the kubeconfig entry.
+func (k kubeconfig) restConfig() (*rest.Config, error) {
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{ExplicitPath: k.path},
+		&clientcmd.ConfigOverrides{CurrentContext: k.context}).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig %s of cluster %s: %w", k.path, k.cluster, err)
+	}
+	return config, nil
+}
+
+// newClients returns the clients of the config, the metrics client being nil
+// unless -pod-usage is set. Building them does not contact the API server.
+func newClients(config *rest.Config) (kubernetes.Interface, metricsclient.Interface, error) {
+	config.UserAgent = "node-resource-exporter (" + rest.DefaultKubernetesUserAgent() + ")"
+	config.QPS = float32(kubeQPS)
+	config.Burst = kubeBurst
+
+	kubeClient, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	var metricsClient metricsclient.Interface
+	if podUsage {
+		if metricsClient, err = metricsclient.NewForConfig(config); err != nil {
+			return nil, nil, err
+		}
+	}
+	return kubeClient, metricsClient, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/dmitsh/node-resource-exporter/pkg/metrics"
+)
+
+// selfTestNode is the name of the synthetic node reported by selfTest.
+const selfTestNode = "self-test"
+
+// selfTest reports a synthetic node carrying every node label into a
+// throwaway snapshot, so that label values not matching the label names of
+// the metrics fail the start instead of panicking in the sampling loop.
+func selfTest(metric *metrics.Metrics) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("metrics self-test failed, label values do not match the label names %v: %v", nodeLabelNames(), r)
+		}
+	}()
+
+	node := &demoNodes(metav1.Now(), trackedResourceNames, nodeLabelKeys)[0]
+	node.Name = selfTestNode
+	usage := demoUsages(rand.New(rand.NewSource(1)), []corev1.Node{*node})[0]
+	usage.podUsage = podUsageIndex{}
+
+	// a throwaway sampler keeps the state of the synthetic node
+	s := newSampler("", nil, nil, nil, metric)
+	snapshot := metric.NewSnapshot()
+	cluster := newClusterUsage()
+	nodeLabelValues := getNodeLabelValues(node)
+	reportNodeStatus(node, nodeLabelValues, snapshot)
+	s.reportNodeUsage(node, nodeLabelValues, usage, trackedResourceNames, time.Now(), cluster, snapshot)
+	cluster.report(snapshot)
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "k8s.io/klog/v2"
+)
+
+// snapshotFields maps the gauges served by /snapshot.json to their field.
+var snapshotFields = map[string]string{
+	"node_resource_requests":  "requests",
+	"node_resource_limits":    "limits",
+	"node_resource_occupancy": "occupancy",
+}
+
+// snapshotNode is the JSON of the resources of a node.
+type snapshotNode struct {
+	Cluster   string                        `json:"cluster,omitempty"`
+	Node      string                        `json:"node"`
+	Labels    map[string]string             `json:"labels,omitempty"`
+	Resources map[string]map[string]float64 `json:"resources"`
+}
+
+// snapshotScore is the JSON of the score of a resource for a set of node labels.
+type snapshotScore struct {
+	Cluster  string            `json:"cluster,omitempty"`
+	Resource string            `json:"resource"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Score    float64           `json:"score"`
+}
+
+type snapshotJSON struct {
+	Nodes  []*snapshotNode `json:"nodes"`
+	Scores []snapshotScore `json:"scores"`
+}
+
+// handleSnapshotJSON serves the requests, limits, occupancy and score of the
+// current snapshots as JSON, for tools not speaking the Prometheus format.
+// The series are gathered like those of the metrics endpoint.
+func handleSnapshotJSON(g prometheus.Gatherer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		families, err := g.Gather()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		snapshot := snapshotJSON{Nodes: []*snapshotNode{}, Scores: []snapshotScore{}}
+		nodes := make(map[[2]string]*snapshotNode)
+		for _, mf := range families {
+			field, ok := snapshotFields[mf.GetName()]
+			if !ok && mf.GetName() != "node_resource_score" {
+				continue
+			}
+			for _, metric := range mf.Metric {
+				var cluster, node, resource string
+				labels := make(map[string]string)
+				for _, lp := range metric.GetLabel() {
+					switch lp.GetName() {
+					case "cluster":
+						cluster = lp.GetValue()
+					case nodeLabelKey:
+						node = lp.GetValue()
+					case "resource":
+						resource = lp.GetValue()
+					default:
+						labels[lp.GetName()] = lp.GetValue()
+					}
+				}
+				if !ok {
+					snapshot.Scores = append(snapshot.Scores, snapshotScore{
+						Cluster: cluster, Resource: resource, Labels: labels, Score: metric.GetGauge().GetValue(),
+					})
+					continue
+				}
+				key := [2]string{cluster, node}
+				n, found := nodes[key]
+				if !found {
+					n = &snapshotNode{Cluster: cluster, Node: node, Labels: labels, Resources: make(map[string]map[string]float64)}
+					nodes[key] = n
+					snapshot.Nodes = append(snapshot.Nodes, n)
+				}
+				if n.Resources[resource] == nil {
+					n.Resources[resource] = make(map[string]float64)
+				}
+				n.Resources[resource][field] = metric.GetGauge().GetValue()
+			}
+		}
+		sort.Slice(snapshot.Nodes, func(i, j int) bool {
+			if snapshot.Nodes[i].Cluster != snapshot.Nodes[j].Cluster {
+				return snapshot.Nodes[i].Cluster < snapshot.Nodes[j].Cluster
+			}
+			return snapshot.Nodes[i].Node < snapshot.Nodes[j].Node
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(snapshot); err != nil {
+			log.Infof("ERROR: failed to write the snapshot: %v", err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	log "k8s.io/klog/v2"
+)
+
+// certReloader serves the -tls-cert-file and -tls-key-file, reloaded on the
+// handshake following a change of their modification time, so that rotated
+// certificates are picked up without a restart. A pair failing to load, such
+// as one caught half-written, is retried on the next handshake while the
+// previous certificate keeps being served.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+// newCertReloader loads the certificate, failing if the initial pair is invalid.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	certInfo, certErr := os.Stat(r.certFile)
+	keyInfo, keyErr := os.Stat(r.keyFile)
+	if certErr == nil && keyErr == nil && r.cert != nil &&
+		certInfo.ModTime().Equal(r.certMod) && keyInfo.ModTime().Equal(r.keyMod) {
+		return r.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert == nil {
+			return nil, err
+		}
+		log.Infof("ERROR: failed to reload the TLS certificate, serving the previous one: %v", err)
+		return r.cert, nil
+	}
+	if r.cert != nil {
+		log.Infof("Reloaded the TLS certificate %s", r.certFile)
+	}
+	r.cert = &cert
+	if certErr == nil && keyErr == nil {
+		r.certMod, r.keyMod = certInfo.ModTime(), keyInfo.ModTime()
+	}
+	return r.cert, nil
+}
+
+// tlsConfig returns the TLS configuration of the servers, or nil without
+// -tls-cert-file.
+func tlsConfig() (*tls.Config, error) {
+	if len(tlsCertFile) == 0 {
+		return nil, nil
+	}
+	reloader, err := newCertReloader(tlsCertFile, tlsKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}, nil
+}
@@ -0,0 +1,702 @@
+package main
+
+import (
+	"context"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/pager"
+	resourcehelper "k8s.io/component-helpers/resource"
+	log "k8s.io/klog/v2"
+)
+
+// nodeUsage holds the resources consumed by the pods running on a node.
+type nodeUsage struct {
+	requests corev1.ResourceList
+	limits   corev1.ResourceList
+	// maxContainerRequests holds the largest single container request
+	maxContainerRequests corev1.ResourceList
+	// maxPodRequests holds the largest single running pod request
+	maxPodRequests corev1.ResourceList
+	// sidecarRequests holds the requests of the -exclude-container-names
+	// containers, left out of the requests
+	sidecarRequests corev1.ResourceList
+	// unboundedPods counts the running pods without a limit of each resource,
+	// left out of the limits, with -effective-limits
+	unboundedPods map[string]int
+	// containerRequests holds the plain sum of the app container requests
+	containerRequests corev1.ResourceList
+	// daemonSetRequests holds the requests of the pods owned by a DaemonSet
+	daemonSetRequests corev1.ResourceList
+	// weightedRequests holds the requests weighted by pod priority, in the
+	// reported units, with -weighted-occupancy
+	weightedRequests map[string]float64
+	// phases counts the pods of the node by phase
+	phases map[corev1.PodPhase]int
+	// requestOverage counts the running pods using more than they request
+	requestOverage int
+	// requestless counts the running pods requesting neither cpu nor memory
+	requestless int
+	// accountedPods counts the running pods added to the requests and limits,
+	// and resourcePods those of them requesting or limiting each resource
+	accountedPods int
+	resourcePods  map[string]int
+	// containers counts the containers of the running pods, init and
+	// ephemeral ones included with -count-all-containers
+	containers int
+	// restarts sums the restart counts of the containers of the running pods
+	restarts int
+	// provisioningGap holds the requests minus the usage of the pods reported
+	// by the metrics server, in the reported units, with -pod-usage
+	provisioningGap map[string]float64
+	// ownerRequests holds the requests of the pods of each top-level
+	// controller, with -requests-by-owner
+	ownerRequests map[podOwner]corev1.ResourceList
+	// priorityRequests holds the requests of the pods of each priority
+	// class, with -requests-by-priority
+	priorityRequests map[string]corev1.ResourceList
+	// skipped counts the listed pods left out of the requests and limits, by
+	// skip reason
+	skipped map[string]int
+	// pods holds the UIDs of the added pods, so that a pod listed twice,
+	// e.g. by a retried or stale list, is counted once
+	pods map[types.UID]bool
+	// claims holds the ResourceClaims of the added pods, with -resource-claims
+	claims map[types.NamespacedName]bool
+
+	podUsage podUsageIndex
+}
+
+// podPhases lists the pod phases reported by node_pod_phase_count.
+var podPhases = []corev1.PodPhase{
+	corev1.PodPending,
+	corev1.PodRunning,
+	corev1.PodSucceeded,
+	corev1.PodFailed,
+	corev1.PodUnknown,
+}
+
+// Reasons of the pods left out of the requests and limits.
+const (
+	skipPhase       = "phase"
+	skipQoS         = "qos"
+	skipTerminating = "terminating"
+)
+
+var skipReasons = []string{skipPhase, skipQoS, skipTerminating}
+
+func newNodeUsage(podUsage podUsageIndex) *nodeUsage {
+	return &nodeUsage{
+		podUsage:             podUsage,
+		requests:             corev1.ResourceList{},
+		limits:               corev1.ResourceList{},
+		maxContainerRequests: corev1.ResourceList{},
+		maxPodRequests:       corev1.ResourceList{},
+		sidecarRequests:      corev1.ResourceList{},
+		unboundedPods:        make(map[string]int),
+		resourcePods:         make(map[string]int),
+		containerRequests:    corev1.ResourceList{},
+		daemonSetRequests:    corev1.ResourceList{},
+		weightedRequests:     make(map[string]float64),
+		phases:               make(map[corev1.PodPhase]int),
+		ownerRequests:        make(map[podOwner]corev1.ResourceList),
+		priorityRequests:     make(map[string]corev1.ResourceList),
+		provisioningGap:      make(map[string]float64),
+		pods:                 make(map[types.UID]bool),
+		claims:               make(map[types.NamespacedName]bool),
+		skipped:              make(map[string]int),
+	}
+}
+
+func (u *nodeUsage) addPod(pod *corev1.Pod) {
+	static := includeStaticPods && isMirrorPod(pod)
+	if includeStaticPods && !static && !podFieldSelector.Matches(podFields(pod)) {
+		return
+	}
+	if u.pods[pod.UID] {
+		log.V(4).Infof("Ignoring duplicate pod %s/%s", pod.Namespace, pod.Name)
+		return
+	}
+	u.pods[pod.UID] = true
+
+	if phase := pod.Status.Phase; len(phase) != 0 {
+		u.phases[phase]++
+	} else {
+		u.phases[corev1.PodUnknown]++
+	}
+
+	if !isAccountedPhase(pod.Status.Phase) {
+		u.skipped[skipPhase]++
+		return
+	}
+	if len(qosClasses) != 0 && !qosClasses[pod.Status.QOSClass] && !static {
+		u.skipped[skipQoS]++
+		return
+	}
+	// terminating pods keep running through their grace period
+	if excludeTerminating && pod.DeletionTimestamp != nil {
+		u.skipped[skipTerminating]++
+		return
+	}
+	if defaultRequestToLimit {
+		pod = withDefaultRequests(pod)
+	}
+	if clampRequestsToLimits {
+		pod = withRequestsClampedToLimits(pod)
+	}
+	if len(excludedContainerNames) != 0 {
+		var sidecarRequests corev1.ResourceList
+		pod, sidecarRequests = withoutExcludedContainers(pod)
+		addResourceList(u.sidecarRequests, sidecarRequests)
+	}
+	if resourceClaims {
+		for _, name := range podClaimNames(pod) {
+			u.claims[types.NamespacedName{Namespace: pod.Namespace, Name: name}] = true
+		}
+	}
+	if pod.Status.Phase == corev1.PodPending {
+		// the scheduler reserved the requests of the pod bound to the node,
+		// which has no limits enforced until its containers start
+		addResourceList(u.requests, resourcehelper.PodRequests(pod, podResourcesOptions()))
+		return
+	}
+	requests, limits := podResources(pod)
+	if requests.Cpu().IsZero() && requests.Memory().IsZero() {
+		u.requestless++
+	}
+	u.accountedPods++
+	for name := range resourceNames(requests, limits) {
+		u.resourcePods[string(name)]++
+	}
+	if effectiveLimits {
+		for _, name := range unboundedResources(pod) {
+			delete(limits, name)
+			u.unboundedPods[string(name)]++
+		}
+	}
+	addResourceList(u.requests, requests)
+	addResourceList(u.limits, limits)
+	addResourceList(u.containerRequests, containerRequests(pod))
+	if isDaemonSetPod(pod) {
+		addResourceList(u.daemonSetRequests, requests)
+	}
+	if requestsByOwner {
+		owner := ownerOf(pod)
+		if u.ownerRequests[owner] == nil {
+			u.ownerRequests[owner] = corev1.ResourceList{}
+		}
+		addResourceList(u.ownerRequests[owner], requests)
+	}
+	if requestsByPriority {
+		class := pod.Spec.PriorityClassName
+		if len(class) == 0 {
+			class = noPriorityClass
+		}
+		if u.priorityRequests[class] == nil {
+			u.priorityRequests[class] = corev1.ResourceList{}
+		}
+		addResourceList(u.priorityRequests[class], requests)
+	}
+	if weightedOccupancy {
+		weight := priorityWeight(pod)
+		for name, quantity := range requests {
+			u.weightedRequests[string(name)] += weight * quantityValue(string(name), quantity)
+		}
+	}
+	for _, container := range pod.Spec.Containers {
+		maxResourceList(u.maxContainerRequests, container.Resources.Requests)
+	}
+	maxResourceList(u.maxPodRequests, requests)
+	u.containers += len(pod.Spec.Containers)
+	for _, status := range pod.Status.ContainerStatuses {
+		u.restarts += int(status.RestartCount)
+	}
+	if countAllContainers {
+		u.containers += len(pod.Spec.InitContainers) + len(pod.Spec.EphemeralContainers)
+	}
+	if usage, ok := u.podUsage[types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}]; ok {
+		if exceedsRequests(usage, requests) {
+			u.requestOverage++
+		}
+		for name, used := range usage {
+			requested := requests[name]
+			u.provisioningGap[string(name)] += quantityValue(string(name), requested) - quantityValue(string(name), used)
+		}
+	}
+}
+
+// isMirrorPod reports whether the pod mirrors a static pod run by the kubelet.
+func isMirrorPod(pod *corev1.Pod) bool {
+	_, ok := pod.Annotations[corev1.MirrorPodAnnotationKey]
+	return ok
+}
+
+// podFields returns the fields of the pod supported by the field selectors
+// of the API server, to match the -pod-field-selector against the pod.
+func podFields(pod *corev1.Pod) fields.Set {
+	return fields.Set{
+		"metadata.name":            pod.Name,
+		"metadata.namespace":       pod.Namespace,
+		"spec.nodeName":            pod.Spec.NodeName,
+		"spec.restartPolicy":       string(pod.Spec.RestartPolicy),
+		"spec.schedulerName":       pod.Spec.SchedulerName,
+		"spec.serviceAccountName":  pod.Spec.ServiceAccountName,
+		"spec.hostNetwork":         strconv.FormatBool(pod.Spec.HostNetwork),
+		"status.phase":             string(pod.Status.Phase),
+		"status.podIP":             pod.Status.PodIP,
+		"status.nominatedNodeName": pod.Status.NominatedNodeName,
+	}
+}
+
+// podClaimNames returns the names of the ResourceClaims of the pod, either
+// referenced by the pod or generated from its ResourceClaimTemplates.
+func podClaimNames(pod *corev1.Pod) []string {
+	var names []string
+	for _, claim := range pod.Spec.ResourceClaims {
+		if claim.ResourceClaimName != nil {
+			names = append(names, *claim.ResourceClaimName)
+			continue
+		}
+		for _, status := range pod.Status.ResourceClaimStatuses {
+			// generated claims have no name until created, nor if not needed
+			if status.Name == claim.Name && status.ResourceClaimName != nil {
+				names = append(names, *status.ResourceClaimName)
+			}
+		}
+	}
+	return names
+}
+
+// listClaimDevices counts the devices allocated to each ResourceClaim of all
+// namespaces, by driver.
+func listClaimDevices(ctx context.Context, kubeClient kubernetes.Interface) (map[types.NamespacedName]map[string]int, error) {
+	claims, err := kubeClient.ResourceV1beta1().ResourceClaims("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make(map[types.NamespacedName]map[string]int, len(claims.Items))
+	for i := range claims.Items {
+		claim := &claims.Items[i]
+		if claim.Status.Allocation == nil {
+			continue
+		}
+		drivers := make(map[string]int)
+		for _, result := range claim.Status.Allocation.Devices.Results {
+			drivers[result.Driver]++
+		}
+		devices[types.NamespacedName{Namespace: claim.Namespace, Name: claim.Name}] = drivers
+	}
+	return devices, nil
+}
+
+// podResources returns the effective requests and limits of the pod, as
+// accounted by the scheduler: init and sidecar containers, pod overhead and
+// pod-level resources (PodLevelResources feature) included. With
+// -limits-aggregation=max, the limits are those of the container with the
+// highest limit of each resource instead.
+func podResources(pod *corev1.Pod) (corev1.ResourceList, corev1.ResourceList) {
+	opts := podResourcesOptions()
+	if limitsAggregation == limitsMax {
+		return resourcehelper.PodRequests(pod, opts), maxContainerLimits(pod)
+	}
+	return resourcehelper.PodRequests(pod, opts), resourcehelper.PodLimits(pod, opts)
+}
+
+// podResourcesOptions returns the options of the pod resources computation.
+// With -use-allocated-resources, the resources of the containers reported in
+// the pod status are accounted for, as the scheduler does with in-place pod
+// resize: the larger of the spec and status resources while a resize is in
+// progress, and the status ones once it is infeasible.
+func podResourcesOptions() resourcehelper.PodResourcesOptions {
+	return resourcehelper.PodResourcesOptions{UseStatusResources: useAllocatedResources}
+}
+
+// boundableResources lists the resources a container may use without limit,
+// up to the node allocatable. The other resources default their limits to
+// their requests, or need limits.
+var boundableResources = []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory, corev1.ResourceEphemeralStorage}
+
+// unboundedResources returns the boundableResources of which a container of
+// the running pod sets no limit, nor the pod itself, so that the pod may use
+// up to the node allocatable. The plain init containers, which completed
+// before the app containers started, are left out, unlike the sidecars
+// running along them.
+func unboundedResources(pod *corev1.Pod) []corev1.ResourceName {
+	containers := slices.Clone(pod.Spec.Containers)
+	for _, container := range pod.Spec.InitContainers {
+		if container.RestartPolicy != nil && *container.RestartPolicy == corev1.ContainerRestartPolicyAlways {
+			containers = append(containers, container)
+		}
+	}
+	var unbounded []corev1.ResourceName
+	for _, name := range boundableResources {
+		if pod.Spec.Resources != nil {
+			if _, ok := pod.Spec.Resources.Limits[name]; ok {
+				continue
+			}
+		}
+		for _, container := range containers {
+			if _, ok := container.Resources.Limits[name]; !ok {
+				unbounded = append(unbounded, name)
+				break
+			}
+		}
+	}
+	return unbounded
+}
+
+// resourceNames returns the resources of which the lists set a non-zero amount.
+func resourceNames(lists ...corev1.ResourceList) map[corev1.ResourceName]bool {
+	names := make(map[corev1.ResourceName]bool)
+	for _, list := range lists {
+		for name, quantity := range list {
+			if !quantity.IsZero() {
+				names[name] = true
+			}
+		}
+	}
+	return names
+}
+
+// maxContainerLimits returns the highest limit of each resource among the
+// init and app containers of the pod, the burst ceiling of any one of them.
+func maxContainerLimits(pod *corev1.Pod) corev1.ResourceList {
+	limits := corev1.ResourceList{}
+	for _, container := range pod.Spec.InitContainers {
+		maxResourceList(limits, container.Resources.Limits)
+	}
+	for _, container := range pod.Spec.Containers {
+		maxResourceList(limits, container.Resources.Limits)
+	}
+	return limits
+}
+
+// withDefaultRequests returns the pod with the requests of its containers
+// defaulting to their limits when unset, as the API server does on creation.
+// Pods created before their LimitRange or bypassing admission may lack them.
+func withDefaultRequests(pod *corev1.Pod) *corev1.Pod {
+	return withAdjustedRequests(pod, func(request *resource.Quantity, limit resource.Quantity) bool {
+		return request == nil
+	})
+}
+
+// withRequestsClampedToLimits returns the pod with the requests of its
+// containers exceeding their limits lowered to the limits.
+func withRequestsClampedToLimits(pod *corev1.Pod) *corev1.Pod {
+	return withAdjustedRequests(pod, func(request *resource.Quantity, limit resource.Quantity) bool {
+		return request != nil && request.Cmp(limit) > 0
+	})
+}
+
+// withoutExcludedContainers returns the pod without its init and app
+// containers matching the -exclude-container-names, and the requests they
+// added to the pod requests. The pod is copied only if a container matches.
+func withoutExcludedContainers(pod *corev1.Pod) (*corev1.Pod, corev1.ResourceList) {
+	excluded := func(container corev1.Container) bool {
+		return isExcludedContainer(container.Name)
+	}
+	if !slices.ContainsFunc(pod.Spec.InitContainers, excluded) && !slices.ContainsFunc(pod.Spec.Containers, excluded) {
+		return pod, nil
+	}
+	copied := pod.DeepCopy()
+	copied.Spec.InitContainers = slices.DeleteFunc(copied.Spec.InitContainers, excluded)
+	copied.Spec.Containers = slices.DeleteFunc(copied.Spec.Containers, excluded)
+
+	// the pod requests are no plain sum of the container ones, see
+	// resourcehelper.PodRequests
+	opts := podResourcesOptions()
+	remaining := resourcehelper.PodRequests(copied, opts)
+	requests := corev1.ResourceList{}
+	for name, quantity := range resourcehelper.PodRequests(pod, opts) {
+		quantity.Sub(remaining[name])
+		if quantity.Sign() > 0 {
+			requests[name] = quantity
+		}
+	}
+	return copied, requests
+}
+
+// isExcludedContainer reports whether the container name matches one of the
+// -exclude-container-names patterns.
+func isExcludedContainer(name string) bool {
+	for _, pattern := range excludedContainerNames {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// withAdjustedRequests returns the pod with the request of each container
+// resource having a limit set to the limit, where replace reports so given
+// the request, nil if unset. The pod is copied only if a request is replaced.
+func withAdjustedRequests(pod *corev1.Pod, replace func(request *resource.Quantity, limit resource.Quantity) bool) *corev1.Pod {
+	var copied *corev1.Pod
+	adjust := func(containers func(*corev1.Pod) []corev1.Container) {
+		for i, container := range containers(pod) {
+			for name, limit := range container.Resources.Limits {
+				var request *resource.Quantity
+				if q, ok := container.Resources.Requests[name]; ok {
+					request = &q
+				}
+				if !replace(request, limit) {
+					continue
+				}
+				if copied == nil {
+					copied = pod.DeepCopy()
+				}
+				c := &containers(copied)[i]
+				if c.Resources.Requests == nil {
+					c.Resources.Requests = corev1.ResourceList{}
+				}
+				c.Resources.Requests[name] = limit.DeepCopy()
+			}
+		}
+	}
+	adjust(func(p *corev1.Pod) []corev1.Container { return p.Spec.InitContainers })
+	adjust(func(p *corev1.Pod) []corev1.Container { return p.Spec.Containers })
+	if copied == nil {
+		return pod
+	}
+	return copied
+}
+
+// noPriorityClass is the priority_class label value of the pods without one.
+const noPriorityClass = "none"
+
+// maxUserPriority is the highest priority of user-defined priority classes.
+const maxUserPriority = 1e9
+
+// priorityWeight returns the weight of the pod requests in the weighted
+// occupancy: from 1 for pods of priority 0 or lower, up to 2 for pods of
+// the highest user-defined priority and above, e.g. system-critical pods.
+func priorityWeight(pod *corev1.Pod) float64 {
+	if pod.Spec.Priority == nil {
+		return 1
+	}
+	return 1 + min(max(float64(*pod.Spec.Priority), 0), maxUserPriority)/maxUserPriority
+}
+
+// isDaemonSetPod reports whether the pod is controlled by a DaemonSet.
+func isDaemonSetPod(pod *corev1.Pod) bool {
+	owner := metav1.GetControllerOf(pod)
+	return owner != nil && owner.Kind == "DaemonSet"
+}
+
+// podOwner is the top-level controller of a pod, empty kind and name for a
+// pod without controller.
+type podOwner struct {
+	namespace string
+	kind      string
+	name      string
+}
+
+// ownerOf returns the top-level controller of the pod. The Deployment of a
+// ReplicaSet is derived from the ReplicaSet name, suffixed by the
+// pod-template-hash label, rather than looked up in the API server.
+func ownerOf(pod *corev1.Pod) podOwner {
+	owner := podOwner{namespace: pod.Namespace}
+	ref := metav1.GetControllerOf(pod)
+	if ref == nil {
+		return owner
+	}
+	owner.kind, owner.name = ref.Kind, ref.Name
+	if hash, ok := pod.Labels[appsv1.DefaultDeploymentUniqueLabelKey]; ok && ref.Kind == "ReplicaSet" {
+		if name, found := strings.CutSuffix(ref.Name, "-"+hash); found {
+			owner.kind, owner.name = "Deployment", name
+		}
+	}
+	return owner
+}
+
+// containerRequests returns the plain sum of the requests of the app containers of the pod.
+func containerRequests(pod *corev1.Pod) corev1.ResourceList {
+	requests := corev1.ResourceList{}
+	for _, container := range pod.Spec.Containers {
+		addResourceList(requests, container.Resources.Requests)
+	}
+	return requests
+}
+
+// listUnscheduledPods counts the pending pods not bound to a node yet, by
+// whether they request cpu or memory and by the extended resources they
+// request that none of the advertised resources provides, and returns their
+// largest request of each resource.
+func listUnscheduledPods(ctx context.Context, kubeClient kubernetes.Interface, advertised map[corev1.ResourceName]bool) (*unscheduledPods, error) {
+	selector := fields.AndSelectors(
+		fields.OneTermEqualSelector("spec.nodeName", ""),
+		fields.OneTermEqualSelector("status.phase", string(corev1.PodPending)),
+	)
+	podList, err := kubeClient.CoreV1().Pods("").List(ctx, metav1.ListOptions{FieldSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[bool]int)
+	largest := corev1.ResourceList{}
+	unadvertised := make(map[corev1.ResourceName]int)
+	for i := range podList.Items {
+		requests, _ := podResources(&podList.Items[i])
+		counts[!requests.Cpu().IsZero() || !requests.Memory().IsZero()]++
+		maxResourceList(largest, requests)
+		for name, v := range requests {
+			if isExtendedResource(name) && !v.IsZero() && !advertised[name] {
+				unadvertised[name]++
+			}
+		}
+	}
+	return &unscheduledPods{counts: counts, largestRequests: largest, unadvertisedRequests: unadvertised}, nil
+}
+
+// nodeConcurrency returns the number of nodes processed concurrently.
+func nodeConcurrency(nodeCount int) int {
+	if concurrency > 0 {
+		return concurrency
+	}
+	return max(1, min(nodeCount, maxDefaultConcurrency))
+}
+
+// isAccountedPhase reports whether the pods of the phase add to the requests
+// and limits: the running pods, the pending ones with
+// -reserved-includes-pending, or with -scheduler-accurate all pods but the
+// terminated ones, as the scheduler does for the pods bound to a node. The
+// scheduler keeps accounting for the terminating pods, and for those of
+// unknown phase, whose node may still run them.
+func isAccountedPhase(phase corev1.PodPhase) bool {
+	if schedulerAccurate {
+		return phase != corev1.PodSucceeded && phase != corev1.PodFailed
+	}
+	return phase == corev1.PodRunning || (reservedIncludesPending && phase == corev1.PodPending)
+}
+
+// podListOptions returns the options listing the pods of the node, or of all
+// nodes if nodeName is empty, combined with the -pod-field-selector.
+//
+// Only the pods of the phases of isAccountedPhase are accounted for, so
+// unless the pod phase metrics need the other pods, they are filtered out by
+// the API server to cut the payload.
+func podListOptions(nodeName string) metav1.ListOptions {
+	var selectors []fields.Selector
+	if len(nodeName) != 0 {
+		selectors = append(selectors, fields.OneTermEqualSelector("spec.nodeName", nodeName))
+	}
+	if !podPhaseMetrics {
+		if reservedIncludesPending || schedulerAccurate {
+			selectors = append(selectors,
+				fields.OneTermNotEqualSelector("status.phase", string(corev1.PodSucceeded)),
+				fields.OneTermNotEqualSelector("status.phase", string(corev1.PodFailed)))
+		} else {
+			selectors = append(selectors, fields.OneTermEqualSelector("status.phase", string(corev1.PodRunning)))
+		}
+	}
+	// with -include-static-pods, the selector is matched by addPod instead,
+	// which lets the static pods through
+	if !podFieldSelector.Empty() && !includeStaticPods {
+		selectors = append(selectors, podFieldSelector)
+	}
+	return metav1.ListOptions{FieldSelector: fields.AndSelectors(selectors...).String()}
+}
+
+// listNodeUsage aggregates the pods of the given nodes using the configured
+// list strategy. The slot of a node whose pods could not be listed is nil.
+func (s *sampler) listNodeUsage(ctx context.Context, nodes []corev1.Node, podUsage podUsageIndex) []*nodeUsage {
+	switch listStrategy {
+	case listSingle:
+		return listNodeUsageSingle(ctx, s.kubeClient, nodes, podUsage)
+	case listInformer:
+		return listNodeUsageInformer(s.podLister, s.podListerSynced, nodes, podUsage)
+	}
+	return listNodeUsagePerNode(ctx, s.kubeClient, nodes, podUsage)
+}
+
+func listNodeUsagePerNode(ctx context.Context, kubeClient kubernetes.Interface, nodes []corev1.Node, podUsage podUsageIndex) []*nodeUsage {
+	// Pods are listed by a bounded pool of workers, each writing only its own
+	// slot of usages. The metrics are then set from the caller's goroutine alone.
+	usages := make([]*nodeUsage, len(nodes))
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(nodeConcurrency(len(nodes)))
+	for i := range nodes {
+		node := &nodes[i]
+		g.Go(func() error {
+			pods, err := kubeClient.CoreV1().Pods("").List(gctx, podListOptions(node.Name))
+			if err != nil {
+				log.Infof("ERROR: failed to get pods for node %s: %v", node.Name, err)
+				return nil
+			}
+			usage := newNodeUsage(podUsage)
+			for j := range pods.Items {
+				usage.addPod(&pods.Items[j])
+			}
+			usages[i] = usage
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	return usages
+}
+
+// listNodeUsageSingle lists the pods of all nodes at once, in pages of
+// -list-page-size pods if set, aggregated as they arrive so that only a page
+// or two are held in memory rather than all the pods of the cluster.
+func listNodeUsageSingle(ctx context.Context, kubeClient kubernetes.Interface, nodes []corev1.Node, podUsage podUsageIndex) []*nodeUsage {
+	usages := make([]*nodeUsage, len(nodes))
+	byNode := make(map[string]*nodeUsage, len(nodes))
+	for i := range nodes {
+		usages[i] = newNodeUsage(podUsage)
+		byNode[nodes[i].Name] = usages[i]
+	}
+
+	p := pager.New(func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error) {
+		return kubeClient.CoreV1().Pods("").List(ctx, opts)
+	})
+	p.PageSize = int64(listPageSize)
+	p.PageBufferSize = 1
+	// a full list after the continue token expired would defeat the paging,
+	// the pass fails instead
+	p.FullListIfExpired = false
+	err := p.EachListItem(ctx, podListOptions(""), func(obj runtime.Object) error {
+		pod := obj.(*corev1.Pod)
+		if usage, ok := byNode[pod.Spec.NodeName]; ok {
+			usage.addPod(pod)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Infof("ERROR: failed to list the pods: %v", err)
+		return make([]*nodeUsage, len(nodes))
+	}
+
+	return usages
+}
+
+func addResourceList(total, addition corev1.ResourceList) {
+	for resourceName, quantity := range addition {
+		if curr, found := total[resourceName]; found {
+			curr.Add(quantity)
+			total[resourceName] = curr
+		} else {
+			total[resourceName] = quantity.DeepCopy()
+		}
+	}
+}
+
+func maxResourceList(total, other corev1.ResourceList) {
+	for resourceName, quantity := range other {
+		if curr, found := total[resourceName]; !found || quantity.Cmp(curr) > 0 {
+			total[resourceName] = quantity.DeepCopy()
+		}
+	}
+}
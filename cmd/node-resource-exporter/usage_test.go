@@ -0,0 +1,737 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+// newPod returns a pod of the node in the phase, named and identified by name.
+func newPod(name, nodeName string, phase corev1.PodPhase, containers ...corev1.Container) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID(name)},
+		Spec:       corev1.PodSpec{NodeName: nodeName, Containers: containers},
+		Status:     corev1.PodStatus{Phase: phase},
+	}
+}
+
+// newContainer returns a container of the requests and limits.
+func newContainer(name string, requests, limits corev1.ResourceList) corev1.Container {
+	return corev1.Container{
+		Name:      name,
+		Resources: corev1.ResourceRequirements{Requests: requests, Limits: limits},
+	}
+}
+
+// newFakeClient returns a fake clientset of the objects whose pod lists
+// honor the field selectors, which the fake object tracker ignores.
+func newFakeClient(objects ...runtime.Object) *fake.Clientset {
+	client := fake.NewClientset(objects...)
+	client.PrependReactor("list", "pods", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		selector := action.(clienttesting.ListAction).GetListRestrictions().Fields
+		obj, err := client.Tracker().List(corev1.SchemeGroupVersion.WithResource("pods"), corev1.SchemeGroupVersion.WithKind("Pod"), action.GetNamespace())
+		if err != nil {
+			return true, nil, err
+		}
+		list := obj.(*corev1.PodList)
+		filtered := &corev1.PodList{ListMeta: list.ListMeta}
+		for _, pod := range list.Items {
+			if selector == nil || selector.Matches(podFields(&pod)) {
+				filtered.Items = append(filtered.Items, pod)
+			}
+		}
+		return true, filtered, nil
+	})
+	return client
+}
+
+func newNode(name string, allocatable corev1.ResourceList) corev1.Node {
+	return corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status:     corev1.NodeStatus{Allocatable: allocatable, Capacity: allocatable},
+	}
+}
+
+func TestListNodeUsageSingleMatchesPerNode(t *testing.T) {
+	requests := resourceList("cpu", "250m", "memory", "256Mi")
+	limits := resourceList("cpu", "500m", "memory", "512Mi")
+	nodes := []corev1.Node{newNode("node-a", nil), newNode("node-b", nil), newNode("node-c", nil)}
+
+	tests := []struct {
+		name            string
+		podPhaseMetrics bool
+		pageSize        int
+		pods            []runtime.Object
+		// wantRequests holds the cpu requests of each node
+		wantRequests []string
+	}{
+		{
+			name: "running pods of several nodes",
+			pods: []runtime.Object{
+				newPod("a1", "node-a", corev1.PodRunning, newContainer("c", requests, limits)),
+				newPod("a2", "node-a", corev1.PodRunning, newContainer("c", requests, limits), newContainer("d", requests, nil)),
+				newPod("b1", "node-b", corev1.PodRunning, newContainer("c", requests, limits)),
+			},
+			wantRequests: []string{"750m", "250m", "0"},
+		},
+		{
+			name:            "pods of all phases with the phase metrics",
+			podPhaseMetrics: true,
+			pods: []runtime.Object{
+				newPod("a1", "node-a", corev1.PodRunning, newContainer("c", requests, limits)),
+				newPod("a2", "node-a", corev1.PodPending, newContainer("c", requests, limits)),
+				newPod("a3", "node-a", corev1.PodSucceeded, newContainer("c", requests, limits)),
+				newPod("b1", "node-b", corev1.PodFailed, newContainer("c", requests, limits)),
+			},
+			wantRequests: []string{"250m", "0", "0"},
+		},
+		{
+			name: "pods of all phases without the phase metrics",
+			pods: []runtime.Object{
+				newPod("a1", "node-a", corev1.PodRunning, newContainer("c", requests, limits)),
+				newPod("a2", "node-a", corev1.PodPending, newContainer("c", requests, limits)),
+				newPod("b1", "node-b", corev1.PodFailed, newContainer("c", requests, limits)),
+			},
+			wantRequests: []string{"250m", "0", "0"},
+		},
+		{
+			name:            "pods of other nodes and unscheduled pods",
+			podPhaseMetrics: true,
+			pods: []runtime.Object{
+				newPod("a1", "node-a", corev1.PodRunning, newContainer("c", requests, limits)),
+				newPod("x1", "node-x", corev1.PodRunning, newContainer("c", requests, limits)),
+				newPod("p1", "", corev1.PodPending, newContainer("c", requests, limits)),
+			},
+			wantRequests: []string{"250m", "0", "0"},
+		},
+		{
+			name:     "paged list",
+			pageSize: 1,
+			pods: []runtime.Object{
+				newPod("a1", "node-a", corev1.PodRunning, newContainer("c", requests, limits)),
+				newPod("b1", "node-b", corev1.PodRunning, newContainer("c", requests, limits)),
+				newPod("c1", "node-c", corev1.PodRunning, newContainer("c", requests, limits)),
+			},
+			wantRequests: []string{"250m", "250m", "250m"},
+		},
+		{
+			name:         "no pods",
+			wantRequests: []string{"0", "0", "0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, &podPhaseMetrics, tt.podPhaseMetrics)
+			setFlag(t, &listPageSize, tt.pageSize)
+			client := newFakeClient(tt.pods...)
+
+			perNode := listNodeUsagePerNode(context.Background(), client, nodes, nil)
+			single := listNodeUsageSingle(context.Background(), client, nodes, nil)
+			for i, node := range nodes {
+				want, got := perNode[i], single[i]
+				if want == nil || got == nil {
+					t.Fatalf("node %s: per-node usage %v, single usage %v", node.Name, want, got)
+				}
+				if cpu := want.requests.Cpu(); cpu.Cmp(resourceList("cpu", tt.wantRequests[i])["cpu"]) != 0 {
+					t.Errorf("node %s: cpu requests %s, want %s", node.Name, cpu, tt.wantRequests[i])
+				}
+				if !equality.Semantic.DeepEqual(got.requests, want.requests) {
+					t.Errorf("node %s: single requests %v, per-node %v", node.Name, got.requests, want.requests)
+				}
+				if !equality.Semantic.DeepEqual(got.limits, want.limits) {
+					t.Errorf("node %s: single limits %v, per-node %v", node.Name, got.limits, want.limits)
+				}
+				if !maps.Equal(got.phases, want.phases) {
+					t.Errorf("node %s: single phases %v, per-node %v", node.Name, got.phases, want.phases)
+				}
+				if !maps.Equal(got.skipped, want.skipped) {
+					t.Errorf("node %s: single skipped %v, per-node %v", node.Name, got.skipped, want.skipped)
+				}
+				if got.accountedPods != want.accountedPods || got.containers != want.containers {
+					t.Errorf("node %s: single %d pods and %d containers, per-node %d and %d",
+						node.Name, got.accountedPods, got.containers, want.accountedPods, want.containers)
+				}
+			}
+		})
+	}
+}
+
+// withPodResources returns the pod with the pod-level requests and limits.
+func withPodResources(pod *corev1.Pod, requests, limits corev1.ResourceList) *corev1.Pod {
+	pod.Spec.Resources = &corev1.ResourceRequirements{Requests: requests, Limits: limits}
+	return pod
+}
+
+func TestPodResourcesPodLevel(t *testing.T) {
+	tests := []struct {
+		name         string
+		pod          *corev1.Pod
+		wantRequests corev1.ResourceList
+		wantLimits   corev1.ResourceList
+	}{
+		{
+			name: "container resources are summed",
+			pod: newPod("p", "n", corev1.PodRunning,
+				newContainer("a", resourceList("cpu", "100m", "memory", "1Gi"), resourceList("cpu", "200m", "memory", "1Gi")),
+				newContainer("b", resourceList("cpu", "200m"), resourceList("cpu", "400m"))),
+			wantRequests: resourceList("cpu", "300m", "memory", "1Gi"),
+			wantLimits:   resourceList("cpu", "600m", "memory", "1Gi"),
+		},
+		{
+			name: "pod-level resources override the containers",
+			pod: withPodResources(newPod("p", "n", corev1.PodRunning,
+				newContainer("a", resourceList("cpu", "100m", "memory", "1Gi"), resourceList("cpu", "200m", "memory", "1Gi")),
+				newContainer("b", resourceList("cpu", "200m"), resourceList("cpu", "400m"))),
+				resourceList("cpu", "1", "memory", "2Gi"), resourceList("cpu", "2", "memory", "4Gi")),
+			wantRequests: resourceList("cpu", "1", "memory", "2Gi"),
+			wantLimits:   resourceList("cpu", "2", "memory", "4Gi"),
+		},
+		{
+			name: "pod-level requests of some resources",
+			pod: withPodResources(newPod("p", "n", corev1.PodRunning,
+				newContainer("a", resourceList("cpu", "100m", "memory", "1Gi"), resourceList("cpu", "200m", "memory", "1Gi"))),
+				resourceList("cpu", "1"), nil),
+			wantRequests: resourceList("cpu", "1", "memory", "1Gi"),
+			wantLimits:   resourceList("cpu", "200m", "memory", "1Gi"),
+		},
+		{
+			name: "extended resources come from the containers",
+			pod: withPodResources(newPod("p", "n", corev1.PodRunning,
+				newContainer("a", resourceList("cpu", "100m", "nvidia.com/gpu", "1"), resourceList("nvidia.com/gpu", "1")),
+				newContainer("b", resourceList("nvidia.com/gpu", "2"), resourceList("nvidia.com/gpu", "2"))),
+				resourceList("cpu", "500m"), resourceList("cpu", "1")),
+			wantRequests: resourceList("cpu", "500m", "nvidia.com/gpu", "3"),
+			wantLimits:   resourceList("cpu", "1", "nvidia.com/gpu", "3"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests, limits := podResources(tt.pod)
+			if !equality.Semantic.DeepEqual(requests, tt.wantRequests) {
+				t.Errorf("requests %v, want %v", requests, tt.wantRequests)
+			}
+			if !equality.Semantic.DeepEqual(limits, tt.wantLimits) {
+				t.Errorf("limits %v, want %v", limits, tt.wantLimits)
+			}
+		})
+	}
+}
+
+func TestAddPodDuplicate(t *testing.T) {
+	requests := resourceList("cpu", "250m")
+	pod := newPod("p1", "node-a", corev1.PodRunning, newContainer("c", requests, nil))
+	// a stale copy of the pod from a retried page, of the same UID
+	stale := pod.DeepCopy()
+	stale.ResourceVersion = "1"
+	other := newPod("p2", "node-a", corev1.PodRunning, newContainer("c", requests, nil))
+
+	tests := []struct {
+		name         string
+		pods         []*corev1.Pod
+		wantRequests string
+		wantPods     int
+	}{
+		{name: "distinct pods", pods: []*corev1.Pod{pod, other}, wantRequests: "500m", wantPods: 2},
+		{name: "same pod twice", pods: []*corev1.Pod{pod, pod}, wantRequests: "250m", wantPods: 1},
+		{name: "stale copy of a pod", pods: []*corev1.Pod{pod, other, stale}, wantRequests: "500m", wantPods: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usage := newNodeUsage(nil)
+			for _, pod := range tt.pods {
+				usage.addPod(pod)
+			}
+			if cpu := usage.requests.Cpu(); cpu.Cmp(resourceList("cpu", tt.wantRequests)["cpu"]) != 0 {
+				t.Errorf("cpu requests %s, want %s", cpu, tt.wantRequests)
+			}
+			if usage.accountedPods != tt.wantPods || usage.phases[corev1.PodRunning] != tt.wantPods {
+				t.Errorf("%d accounted and %d running pods, want %d", usage.accountedPods, usage.phases[corev1.PodRunning], tt.wantPods)
+			}
+		})
+	}
+}
+
+func TestListNodeUsageDuplicatePod(t *testing.T) {
+	pod := newPod("p1", "node-a", corev1.PodRunning, newContainer("c", resourceList("cpu", "250m"), nil))
+	client := newFakeClient()
+	// the list of a retried request returning the pod twice
+	client.PrependReactor("list", "pods", func(clienttesting.Action) (bool, runtime.Object, error) {
+		return true, &corev1.PodList{Items: []corev1.Pod{*pod, *pod}}, nil
+	})
+	nodes := []corev1.Node{newNode("node-a", nil)}
+	for name, list := range map[string]func(context.Context, kubernetes.Interface, []corev1.Node, podUsageIndex) []*nodeUsage{
+		"per node": listNodeUsagePerNode,
+		"single":   listNodeUsageSingle,
+	} {
+		usage := list(context.Background(), client, nodes, nil)[0]
+		if cpu := usage.requests.Cpu(); cpu.Cmp(resourceList("cpu", "250m")["cpu"]) != 0 || usage.accountedPods != 1 {
+			t.Errorf("%s: cpu requests %s of %d pods, want 250m of 1", name, cpu, usage.accountedPods)
+		}
+	}
+}
+
+// withInitContainers returns the pod with the init containers.
+func withInitContainers(pod *corev1.Pod, containers ...corev1.Container) *corev1.Pod {
+	pod.Spec.InitContainers = containers
+	return pod
+}
+
+// newSidecar returns an init container restarting always, of the requests
+// and limits.
+func newSidecar(name string, requests, limits corev1.ResourceList) corev1.Container {
+	container := newContainer(name, requests, limits)
+	always := corev1.ContainerRestartPolicyAlways
+	container.RestartPolicy = &always
+	return container
+}
+
+func TestPodResourcesLimitsAggregation(t *testing.T) {
+	limits := func(cpu string) corev1.ResourceList { return resourceList("cpu", cpu) }
+	overhead := newPod("p", "n", corev1.PodRunning, newContainer("a", nil, limits("1")), newContainer("b", nil, limits("500m")))
+	overhead.Spec.Overhead = resourceList("cpu", "250m")
+
+	tests := []struct {
+		name    string
+		pod     *corev1.Pod
+		wantSum string
+		wantMax string
+	}{
+		{
+			name:    "app containers",
+			pod:     newPod("p", "n", corev1.PodRunning, newContainer("a", nil, limits("1")), newContainer("b", nil, limits("500m"))),
+			wantSum: "1500m",
+			wantMax: "1",
+		},
+		{
+			name: "init container above the app containers",
+			pod: withInitContainers(newPod("p", "n", corev1.PodRunning, newContainer("a", nil, limits("1")), newContainer("b", nil, limits("500m"))),
+				newContainer("init", nil, limits("2"))),
+			wantSum: "2",
+			wantMax: "2",
+		},
+		{
+			name: "init container below the app containers",
+			pod: withInitContainers(newPod("p", "n", corev1.PodRunning, newContainer("a", nil, limits("1")), newContainer("b", nil, limits("500m"))),
+				newContainer("init", nil, limits("1200m"))),
+			wantSum: "1500m",
+			wantMax: "1200m",
+		},
+		{
+			name: "sidecar init container running along the app containers",
+			pod: withInitContainers(newPod("p", "n", corev1.PodRunning, newContainer("a", nil, limits("1"))),
+				newSidecar("sidecar", nil, limits("300m"))),
+			wantSum: "1300m",
+			wantMax: "1",
+		},
+		{
+			// the overhead is no container's
+			name:    "pod overhead",
+			pod:     overhead,
+			wantSum: "1750m",
+			wantMax: "1",
+		},
+	}
+	for _, tt := range tests {
+		for aggregation, want := range map[string]string{limitsSum: tt.wantSum, limitsMax: tt.wantMax} {
+			t.Run(tt.name+" "+aggregation, func(t *testing.T) {
+				setFlag(t, &limitsAggregation, aggregation)
+				_, limits := podResources(tt.pod)
+				if cpu := limits.Cpu(); cpu.Cmp(resourceList("cpu", want)["cpu"]) != 0 {
+					t.Errorf("cpu limits %s, want %s", cpu, want)
+				}
+			})
+		}
+	}
+}
+
+// withStatusResources returns the pod with the resources of its container
+// reported in its status, and the resize status.
+func withStatusResources(pod *corev1.Pod, container string, requests, limits corev1.ResourceList, resize corev1.PodResizeStatus) *corev1.Pod {
+	pod.Status.ContainerStatuses = append(pod.Status.ContainerStatuses, corev1.ContainerStatus{
+		Name:      container,
+		Resources: &corev1.ResourceRequirements{Requests: requests, Limits: limits},
+	})
+	pod.Status.Resize = resize
+	return pod
+}
+
+func TestPodResourcesResize(t *testing.T) {
+	resized := func(resize corev1.PodResizeStatus, statusCPU string) *corev1.Pod {
+		pod := newPod("p", "n", corev1.PodRunning,
+			newContainer("a", resourceList("cpu", "1"), resourceList("cpu", "2")),
+			newContainer("b", resourceList("cpu", "500m"), resourceList("cpu", "500m")))
+		return withStatusResources(pod, "a", resourceList("cpu", statusCPU), resourceList("cpu", statusCPU), resize)
+	}
+
+	tests := []struct {
+		name        string
+		pod         *corev1.Pod
+		allocated   bool
+		wantRequest string
+		wantLimit   string
+	}{
+		{
+			name:        "spec resources without -use-allocated-resources",
+			pod:         resized(corev1.PodResizeStatusInProgress, "1500m"),
+			wantRequest: "1500m",
+			wantLimit:   "2500m",
+		},
+		{
+			name:        "upsize in progress",
+			pod:         resized(corev1.PodResizeStatusInProgress, "1500m"),
+			allocated:   true,
+			wantRequest: "2",
+			wantLimit:   "2500m",
+		},
+		{
+			name:        "downsize in progress",
+			pod:         resized(corev1.PodResizeStatusInProgress, "250m"),
+			allocated:   true,
+			wantRequest: "1500m",
+			wantLimit:   "2500m",
+		},
+		{
+			name:        "proposed resize",
+			pod:         resized(corev1.PodResizeStatusProposed, "3"),
+			allocated:   true,
+			wantRequest: "3500m",
+			wantLimit:   "3500m",
+		},
+		{
+			name:        "infeasible resize",
+			pod:         resized(corev1.PodResizeStatusInfeasible, "250m"),
+			allocated:   true,
+			wantRequest: "750m",
+			wantLimit:   "750m",
+		},
+		{
+			name:        "resize done",
+			pod:         resized("", "1"),
+			allocated:   true,
+			wantRequest: "1500m",
+			wantLimit:   "2500m",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, &useAllocatedResources, tt.allocated)
+			requests, limits := podResources(tt.pod)
+			if cpu := requests.Cpu(); cpu.Cmp(resourceList("cpu", tt.wantRequest)["cpu"]) != 0 {
+				t.Errorf("cpu requests %s, want %s", cpu, tt.wantRequest)
+			}
+			if cpu := limits.Cpu(); cpu.Cmp(resourceList("cpu", tt.wantLimit)["cpu"]) != 0 {
+				t.Errorf("cpu limits %s, want %s", cpu, tt.wantLimit)
+			}
+		})
+	}
+}
+
+func TestIsExcludedContainer(t *testing.T) {
+	setFlag(t, &excludedContainerNames, []string{"istio-proxy", "linkerd-*"})
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "istio-proxy", want: true},
+		{name: "linkerd-proxy", want: true},
+		{name: "linkerd-init", want: true},
+		{name: "istio-proxy-2"},
+		{name: "linkerd"},
+		{name: "app"},
+	}
+	for _, tt := range tests {
+		if got := isExcludedContainer(tt.name); got != tt.want {
+			t.Errorf("container %s excluded %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWithoutExcludedContainers(t *testing.T) {
+	setFlag(t, &excludedContainerNames, []string{"istio-proxy", "linkerd-*"})
+	cpu := func(amount string) corev1.ResourceList { return resourceList("cpu", amount) }
+
+	tests := []struct {
+		name         string
+		pod          *corev1.Pod
+		wantRequests string
+		// wantSidecar is empty when no container is excluded
+		wantSidecar string
+	}{
+		{
+			name:         "unmatched containers",
+			pod:          newPod("p", "n", corev1.PodRunning, newContainer("app", cpu("1"), nil), newContainer("istio-proxy-2", cpu("100m"), nil)),
+			wantRequests: "1100m",
+		},
+		{
+			name:         "matched app container",
+			pod:          newPod("p", "n", corev1.PodRunning, newContainer("app", cpu("1"), nil), newContainer("istio-proxy", cpu("100m"), nil)),
+			wantRequests: "1",
+			wantSidecar:  "100m",
+		},
+		{
+			name: "matched init container below the app containers",
+			pod: withInitContainers(newPod("p", "n", corev1.PodRunning, newContainer("app", cpu("1"), nil)),
+				newContainer("linkerd-init", cpu("500m"), nil)),
+			wantRequests: "1",
+			wantSidecar:  "0",
+		},
+		{
+			// the sidecar runs along the app containers and the init
+			// containers after it: max(1+200m, 2+200m)
+			name: "matched sidecar init container",
+			pod: withInitContainers(newPod("p", "n", corev1.PodRunning, newContainer("app", cpu("1"), nil)),
+				newSidecar("linkerd-proxy", cpu("200m"), nil), newContainer("init", cpu("2"), nil)),
+			wantRequests: "2",
+			wantSidecar:  "200m",
+		},
+		{
+			// the init container running before the sidecar outweighs the
+			// sidecar and the app containers: max(1+200m, 2)
+			name: "matched sidecar init container after an init container",
+			pod: withInitContainers(newPod("p", "n", corev1.PodRunning, newContainer("app", cpu("1"), nil)),
+				newContainer("init", cpu("2"), nil), newSidecar("linkerd-proxy", cpu("200m"), nil)),
+			wantRequests: "2",
+			wantSidecar:  "0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod, sidecar := withoutExcludedContainers(tt.pod)
+			if len(tt.wantSidecar) == 0 {
+				if pod != tt.pod || sidecar != nil {
+					t.Errorf("pod copied with sidecar requests %v, want the pod as is", sidecar)
+				}
+			} else if got := sidecar.Cpu(); got.Cmp(resource.MustParse(tt.wantSidecar)) != 0 {
+				t.Errorf("sidecar cpu requests %s, want %s", got, tt.wantSidecar)
+			}
+			requests, _ := podResources(pod)
+			if got := requests.Cpu(); got.Cmp(resource.MustParse(tt.wantRequests)) != 0 {
+				t.Errorf("cpu requests %s, want %s", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestAccountedPhases(t *testing.T) {
+	requests := resourceList("cpu", "100m")
+	terminating := newPod("p", "n", corev1.PodRunning, newContainer("c", requests, nil))
+	terminating.DeletionTimestamp = &metav1.Time{}
+
+	modes := []struct {
+		name                    string
+		reservedIncludesPending bool
+		schedulerAccurate       bool
+	}{
+		{name: "default"},
+		{name: "reserved includes pending", reservedIncludesPending: true},
+		{name: "scheduler accurate", schedulerAccurate: true},
+	}
+	tests := []struct {
+		name string
+		pod  *corev1.Pod
+		// want holds the cpu requests of each mode
+		want [3]string
+	}{
+		{name: "running", pod: newPod("p", "n", corev1.PodRunning, newContainer("c", requests, nil)), want: [3]string{"100m", "100m", "100m"}},
+		{name: "pending", pod: newPod("p", "n", corev1.PodPending, newContainer("c", requests, nil)), want: [3]string{"0", "100m", "100m"}},
+		{name: "unknown", pod: newPod("p", "n", corev1.PodUnknown, newContainer("c", requests, nil)), want: [3]string{"0", "0", "100m"}},
+		{name: "terminating", pod: terminating, want: [3]string{"100m", "100m", "100m"}},
+		{name: "succeeded", pod: newPod("p", "n", corev1.PodSucceeded, newContainer("c", requests, nil)), want: [3]string{"0", "0", "0"}},
+		{name: "failed", pod: newPod("p", "n", corev1.PodFailed, newContainer("c", requests, nil)), want: [3]string{"0", "0", "0"}},
+	}
+	for _, tt := range tests {
+		for i, mode := range modes {
+			t.Run(tt.name+" "+mode.name, func(t *testing.T) {
+				setFlag(t, &reservedIncludesPending, mode.reservedIncludesPending)
+				setFlag(t, &schedulerAccurate, mode.schedulerAccurate)
+				usage := newNodeUsage(nil)
+				usage.addPod(tt.pod)
+				if cpu := usage.requests.Cpu(); cpu.Cmp(resource.MustParse(tt.want[i])) != 0 {
+					t.Errorf("cpu requests %s, want %s", cpu, tt.want[i])
+				}
+				skipped := 0
+				if tt.want[i] == "0" {
+					skipped = 1
+				}
+				if usage.skipped[skipPhase] != skipped {
+					t.Errorf("%d pods skipped by phase, want %d", usage.skipped[skipPhase], skipped)
+				}
+			})
+		}
+	}
+}
+
+func TestClampRequestsToLimits(t *testing.T) {
+	// the first container requests more cpu than it is limited to, the
+	// second one has no limits to cap its requests
+	pod := newPod("p", "n", corev1.PodRunning,
+		newContainer("overcommitted", resourceList("cpu", "2", "memory", "1Gi"), resourceList("cpu", "1", "memory", "2Gi")),
+		newContainer("unlimited", resourceList("cpu", "500m", "memory", "256Mi"), nil))
+
+	tests := []struct {
+		name       string
+		clamp      bool
+		wantCPU    string
+		wantMemory string
+	}{
+		{name: "requests as is", wantCPU: "2500m", wantMemory: "1280Mi"},
+		{name: "requests clamped", clamp: true, wantCPU: "1500m", wantMemory: "1280Mi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, &clampRequestsToLimits, tt.clamp)
+			usage := newNodeUsage(nil)
+			usage.addPod(pod)
+			if cpu := usage.requests.Cpu(); cpu.Cmp(resource.MustParse(tt.wantCPU)) != 0 {
+				t.Errorf("cpu requests %s, want %s", cpu, tt.wantCPU)
+			}
+			if memory := usage.requests.Memory(); memory.Cmp(resource.MustParse(tt.wantMemory)) != 0 {
+				t.Errorf("memory requests %s, want %s", memory, tt.wantMemory)
+			}
+			if requests := pod.Spec.Containers[0].Resources.Requests; requests.Cpu().Cmp(resource.MustParse("2")) != 0 {
+				t.Errorf("pod container cpu requests changed to %s", requests.Cpu())
+			}
+		})
+	}
+}
+
+func TestExcludeTerminating(t *testing.T) {
+	requests := resourceList("cpu", "100m")
+	terminating := newPod("p1", "n", corev1.PodRunning, newContainer("c", requests, nil))
+	terminating.DeletionTimestamp = &metav1.Time{}
+	running := newPod("p2", "n", corev1.PodRunning, newContainer("c", requests, nil))
+
+	tests := []struct {
+		name        string
+		exclude     bool
+		wantCPU     string
+		wantSkipped int
+	}{
+		{name: "terminating pod counted", wantCPU: "200m"},
+		{name: "terminating pod excluded", exclude: true, wantCPU: "100m", wantSkipped: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, &excludeTerminating, tt.exclude)
+			usage := newNodeUsage(nil)
+			usage.addPod(terminating)
+			usage.addPod(running)
+			if cpu := usage.requests.Cpu(); cpu.Cmp(resource.MustParse(tt.wantCPU)) != 0 {
+				t.Errorf("cpu requests %s, want %s", cpu, tt.wantCPU)
+			}
+			if usage.skipped[skipTerminating] != tt.wantSkipped {
+				t.Errorf("%d terminating pods skipped, want %d", usage.skipped[skipTerminating], tt.wantSkipped)
+			}
+		})
+	}
+}
+
+func TestUnboundedResources(t *testing.T) {
+	limits := resourceList("cpu", "1", "memory", "1Gi", "ephemeral-storage", "1Gi")
+	limited := newContainer("app", limits, limits)
+	tests := []struct {
+		name string
+		pod  *corev1.Pod
+		want []corev1.ResourceName
+	}{
+		{
+			name: "limited app containers",
+			pod:  newPod("p", "n", corev1.PodRunning, limited),
+		},
+		{
+			name: "limitless plain init container",
+			pod:  withInitContainers(newPod("p", "n", corev1.PodRunning, limited), newContainer("init", resourceList("cpu", "2"), nil)),
+		},
+		{
+			name: "limitless sidecar",
+			pod:  withInitContainers(newPod("p", "n", corev1.PodRunning, limited), newSidecar("sidecar", resourceList("cpu", "100m"), resourceList("memory", "64Mi"))),
+			want: []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceEphemeralStorage},
+		},
+		{
+			name: "limitless app container",
+			pod:  newPod("p", "n", corev1.PodRunning, limited, newContainer("other", resourceList("cpu", "1"), nil)),
+			want: boundableResources,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unboundedResources(tt.pod); !slices.Equal(got, tt.want) {
+				t.Errorf("unbounded resources %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPodListOptions(t *testing.T) {
+	tests := []struct {
+		name                    string
+		nodeName                string
+		podPhaseMetrics         bool
+		reservedIncludesPending bool
+		schedulerAccurate       bool
+		podFieldSelector        string
+		includeStaticPods       bool
+		want                    string
+	}{
+		{name: "phase metrics", nodeName: "node-a", podPhaseMetrics: true, want: "spec.nodeName=node-a"},
+		{name: "phase metrics of all nodes", podPhaseMetrics: true, want: ""},
+		{name: "running pods", nodeName: "node-a", want: "spec.nodeName=node-a,status.phase=Running"},
+		{name: "running pods of all nodes", want: "status.phase=Running"},
+		{
+			name:                    "reserved includes pending",
+			nodeName:                "node-a",
+			reservedIncludesPending: true,
+			want:                    "spec.nodeName=node-a,status.phase!=Succeeded,status.phase!=Failed",
+		},
+		{
+			name:              "scheduler accurate",
+			nodeName:          "node-a",
+			schedulerAccurate: true,
+			want:              "spec.nodeName=node-a,status.phase!=Succeeded,status.phase!=Failed",
+		},
+		{
+			name:              "scheduler accurate with phase metrics",
+			nodeName:          "node-a",
+			podPhaseMetrics:   true,
+			schedulerAccurate: true,
+			want:              "spec.nodeName=node-a",
+		},
+		{
+			name:             "pod field selector",
+			nodeName:         "node-a",
+			podFieldSelector: "metadata.namespace!=kube-system",
+			want:             "spec.nodeName=node-a,status.phase=Running,metadata.namespace!=kube-system",
+		},
+		{
+			name:              "pod field selector matched by addPod",
+			nodeName:          "node-a",
+			podFieldSelector:  "metadata.namespace!=kube-system",
+			includeStaticPods: true,
+			want:              "spec.nodeName=node-a,status.phase=Running",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, &podPhaseMetrics, tt.podPhaseMetrics)
+			setFlag(t, &reservedIncludesPending, tt.reservedIncludesPending)
+			setFlag(t, &schedulerAccurate, tt.schedulerAccurate)
+			setFlag(t, &includeStaticPods, tt.includeStaticPods)
+			setFlag(t, &podFieldSelector, fields.ParseSelectorOrDie(tt.podFieldSelector))
+			if got := podListOptions(tt.nodeName).FieldSelector; got != tt.want {
+				t.Errorf("field selector %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
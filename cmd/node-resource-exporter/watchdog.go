@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// lastAttempt holds the time in Unix nanoseconds of the end of the last
+// sampling pass, successful or not, or of the start of the exporter until
+// the first one ends. lastSample holds the time of the last successful pass.
+// The liveness of the exporter rests on the former: a pass failing e.g.
+// through an API server outage shows the loop alive, and restarting the
+// exporter would not help.
+var lastAttempt, lastSample atomic.Int64
+
+func init() {
+	now := time.Now().UnixNano()
+	lastAttempt.Store(now)
+	lastSample.Store(now)
+}
+
+// markAttempted records the end of a sampling pass, which may have failed.
+func markAttempted() {
+	lastAttempt.Store(time.Now().UnixNano())
+}
+
+// markSampled records the completion of a successful sampling pass.
+func markSampled() {
+	now := time.Now().UnixNano()
+	lastAttempt.Store(now)
+	lastSample.Store(now)
+	sampled.Store(true)
+}
+
+// sinceLastSample returns the time since the last successful sampling pass.
+func sinceLastSample() time.Duration {
+	return time.Since(time.Unix(0, lastSample.Load()))
+}
+
+// samplingStuck reports whether no sampling pass ended within
+// -watchdog-intervals sampling intervals, and the time since the last one.
+func samplingStuck() (time.Duration, bool) {
+	if watchdogIntervals <= 0 || scrapeTimeCollection {
+		return 0, false
+	}
+	since := time.Since(time.Unix(0, lastAttempt.Load()))
+	return since, since > time.Duration(watchdogIntervals)*samplingInterval
+}
+
+// startWatchdog returns an error once the sampling loop is stuck.
+func startWatchdog(ctx context.Context) error {
+	ticker := time.NewTicker(samplingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if since, stuck := samplingStuck(); stuck {
+				return fmt.Errorf("sampling loop is stuck, no sampling pass ended for %v", since.Round(time.Second))
+			}
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	clienttesting "k8s.io/client-go/testing"
+
+	"github.com/dmitsh/node-resource-exporter/pkg/metrics"
+)
+
+// newTestSampler returns a sampler of the client with its own registry.
+func newTestSampler(t *testing.T, client kubernetes.Interface) *sampler {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	return newSampler("", client, nil, reg, metrics.New(reg, nodeLabelKey, nodeLabelNames(), nil))
+}
+
+func TestSamplingStuck(t *testing.T) {
+	setFlag(t, &watchdogIntervals, 6)
+	setFlag(t, &nodeLabelKey, "node")
+	long := 10 * samplingInterval
+
+	tests := []struct {
+		name        string
+		listErr     error
+		wantStuck   bool
+		wantSuccess bool
+	}{
+		{name: "successful pass", wantSuccess: true},
+		{name: "failing pass keeps the exporter live", listErr: errors.New("API server unavailable")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stale := time.Now().Add(-long).UnixNano()
+			lastAttempt.Store(stale)
+			lastSample.Store(stale)
+			if _, stuck := samplingStuck(); !stuck {
+				t.Fatalf("not stuck without a pass for %v", long)
+			}
+
+			client := newFakeClient()
+			if tt.listErr != nil {
+				client.PrependReactor("list", "nodes", func(clienttesting.Action) (bool, runtime.Object, error) {
+					return true, nil, tt.listErr
+				})
+			}
+			s := newTestSampler(t, client)
+			if _, err := s.reportResourceUsage(context.Background()); (err != nil) != (tt.listErr != nil) {
+				t.Fatalf("pass error %v, want %v", err, tt.listErr)
+			}
+			if _, stuck := samplingStuck(); stuck != tt.wantStuck {
+				t.Errorf("stuck %v after the pass, want %v", stuck, tt.wantStuck)
+			}
+			if success := sinceLastSample() < long; success != tt.wantSuccess {
+				t.Errorf("successful sample recorded %v, want %v", success, tt.wantSuccess)
+			}
+		})
+	}
+}
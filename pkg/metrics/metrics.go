@@ -1,72 +1,887 @@
 package metrics
 
 import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
 )
 
+// Metrics is a prometheus.Collector exposing the latest Snapshot published
+// by the sampling loop, so that every scrape reflects a single sampling pass
+// and series of removed nodes disappear with the next snapshot.
+//
+// The node labels of the metrics change with reloads, so Metrics is an
+// unchecked collector, describing no metrics upfront.
 type Metrics struct {
+	// NodeScrapes counts the nodes sampled by result, across snapshots.
+	NodeScrapes *prometheus.CounterVec
+	// InformerResets counts the watch errors of the pod informer.
+	InformerResets prometheus.Counter
+	// SampleInterval is the configured interval between two sampling passes.
+	SampleInterval prometheus.Gauge
+	// Stale is set while the served snapshot is the one of a previous pass.
+	Stale prometheus.Gauge
+	// SeriesSet and SeriesDeleted count the series of the published snapshots,
+	// and those of the previous snapshot missing from the next one.
+	SeriesSet     prometheus.Counter
+	SeriesDeleted prometheus.Counter
+	// InvalidValues counts the resource amounts left out as neither finite
+	// nor non-negative, by resource.
+	InvalidValues *prometheus.CounterVec
+	// LabelDrift counts the -l node labels appearing on or disappearing from
+	// a node between two sampling passes, by label.
+	LabelDrift *prometheus.CounterVec
+	// TickTimeouts counts the sampling passes aborted by their deadline.
+	TickTimeouts prometheus.Counter
+	// NodeResourceOccupancySummary holds the occupancies of each node
+	// resource over time, labeled like the node resource gauges. It is nil
+	// unless enabled by EnableOccupancySummary, and created anew, without
+	// its observations, when New changes the node labels.
+	NodeResourceOccupancySummary *prometheus.SummaryVec
+	// summaryOpts are the options NodeResourceOccupancySummary was enabled
+	// with
+	summaryOpts prometheus.SummaryOpts
+	// NodePodDensity observes the running pods of each node at each sampling
+	// pass into a native histogram. It is nil unless enabled by
+	// EnablePodDensityHistogram.
+	NodePodDensity prometheus.Histogram
+
+	mu sync.RWMutex
+	// nodeKey is the name of the label of the node name
+	nodeKey    string
+	nodeLabels []string
+	// unitsHelp documents the resource units in the Help of resource amounts
+	unitsHelp string
+	snapshot  *Snapshot
+	// series holds the keys of the series of the snapshot, see seriesKeys
+	series map[string]bool
+	// generation is the number of snapshots published so far
+	generation uint64
+
+	refreshMu  sync.Mutex
+	refresh    func()
+	refreshTTL time.Duration
+	refreshed  time.Time
+}
+
+// Snapshot holds the gauges set during a single sampling pass.
+type Snapshot struct {
+	collectors collectorList
+	// generation numbers the snapshot once published, 0 for the initial one
+	generation uint64
+
 	NodeLabelNames        []string
 	NodeResourceRequests  *prometheus.GaugeVec
 	NodeResourceLimits    *prometheus.GaugeVec
 	NodeResourceOccupancy *prometheus.GaugeVec
 	NodeResourceScore     *prometheus.GaugeVec
+	// NodeResourceScoreSamples, NodeResourceScoreSum and
+	// NodeResourceScoreWeight are the terms of the average occupancy of the
+	// score, see ScoreStats
+	NodeResourceScoreSamples *prometheus.GaugeVec
+	NodeResourceScoreSum     *prometheus.GaugeVec
+	NodeResourceScoreWeight  *prometheus.GaugeVec
+
+	NodeResourceWeightedOccupancy *prometheus.GaugeVec
+	NodeResourceOccupancyLimits   *prometheus.GaugeVec
+	NodeResourceOverloaded        *prometheus.GaugeVec
+	NodeResourceOccupancyEWMA     *prometheus.GaugeVec
+
+	NodeResourceAllocatable         *prometheus.GaugeVec
+	NodeResourceAvailable           *prometheus.GaugeVec
+	NodeResourceOvercommitted       *prometheus.GaugeVec
+	NodeResourceWorkloadHeadroom    *prometheus.GaugeVec
+	NodeResourceSchedulableRatio    *prometheus.GaugeVec
+	NodeResourceLimitRequestRatio   *prometheus.GaugeVec
+	NodeResourceMaxContainerRequest *prometheus.GaugeVec
+	NodeResourceRequestsDelta       *prometheus.GaugeVec
+	NodeResourceEffectiveDelta      *prometheus.GaugeVec
+	NodeResourceProvisioningGap     *prometheus.GaugeVec
+	NodeResourceRequestsSidecar     *prometheus.GaugeVec
+	NodePodExceedsAllocatable       *prometheus.GaugeVec
+	NodeResourceUnboundedPodCount   *prometheus.GaugeVec
+
+	NodeResourceRequestsClusterFraction *prometheus.GaugeVec
+	NodeResourceRequestsQuantity        *prometheus.GaugeVec
+	NodeResourceRequestsByOwner         *prometheus.GaugeVec
+	NodeResourceRequestsByPriority      *prometheus.GaugeVec
+	// NodeResourceAllocatableChanged counts the changes of the allocatable
+	// amount between two passes, carried over from snapshot to snapshot
+	NodeResourceAllocatableChanged *prometheus.CounterVec
+
+	NodeAge     *prometheus.GaugeVec
+	NodeReady   *prometheus.GaugeVec
+	NodeInfo    *prometheus.GaugeVec
+	NodeTainted *prometheus.GaugeVec
+
+	NodeLastUpdate    *prometheus.GaugeVec
+	NodePodPhaseCount *prometheus.GaugeVec
+	NodePodsSkipped   *prometheus.GaugeVec
+	// NodeResourceClaims counts the devices allocated to the resource claims
+	// of the pods of the node, by driver, with -resource-claims
+	NodeResourceClaims *prometheus.GaugeVec
+	// NodePodCountBucket counts the nodes running at most le pods, for each
+	// of NodePodCountBuckets and +Inf, and NodePodCountCount and
+	// NodePodCountSum the nodes and their running pods, as a gauge histogram
+	// of the latest pass
+	NodePodCountBucket *prometheus.GaugeVec
+	NodePodCountCount  prometheus.Gauge
+	NodePodCountSum    prometheus.Gauge
+
+	NodePodRequestOverage *prometheus.GaugeVec
+	NodeRequestlessPods   *prometheus.GaugeVec
+	NodeIdle              *prometheus.GaugeVec
+	NodeContainerCount    *prometheus.GaugeVec
+	NodeContainerRestarts *prometheus.GaugeVec
+	// NodeActiveResourceCount is the number of tracked resources requested on the node
+	NodeActiveResourceCount *prometheus.GaugeVec
+	// NodeMemoryPerCPURequested is set when cpu is requested on the node
+	NodeMemoryPerCPURequested *prometheus.GaugeVec
+	// NodeFitsLargestRequest is set when the unscheduled pods are listed
+	NodeFitsLargestRequest *prometheus.GaugeVec
+
+	ClusterMaxNodeOccupancy     *prometheus.GaugeVec
+	ClusterMaxNodeOccupancyInfo *prometheus.GaugeVec
+	ClusterUnscheduledPodCount  *prometheus.GaugeVec
+	ClusterResourceAvailable    *prometheus.GaugeVec
+	// ClusterUnschedulableResource is set when the unscheduled pods are listed
+	ClusterUnschedulableResource *prometheus.GaugeVec
+
+	// PoolResourceOccupancyMin, Max and Avg aggregate the occupancies of the
+	// nodes of each pool, with -pool-label
+	PoolResourceOccupancyMin *prometheus.GaugeVec
+	PoolResourceOccupancyMax *prometheus.GaugeVec
+	PoolResourceOccupancyAvg *prometheus.GaugeVec
+	// InstanceTypeResourceOccupancy is the occupancy of the sum of the nodes
+	// of each instance type
+	InstanceTypeResourceOccupancy *prometheus.GaugeVec
+	// ZoneResourceOccupancySkew is the difference between the most and least
+	// occupied zones
+	ZoneResourceOccupancySkew *prometheus.GaugeVec
+
+	// ClusterResourceOccupancyQuantile holds the quantiles of the node
+	// occupancies over the last passes, with -occupancy-quantile-window
+	ClusterResourceOccupancyQuantile *prometheus.GaugeVec
+
+	NamespaceResourceQuotaUsed *prometheus.GaugeVec
+	NamespaceResourceQuotaHard *prometheus.GaugeVec
+
+	InformerSynced *prometheus.GaugeVec
+	// UnusedLabelKeys counts the node labels of -l no node has
+	UnusedLabelKeys *prometheus.GaugeVec
+	// NodesNotReadyForMetrics counts the nodes without allocatable resources
+	NodesNotReadyForMetrics *prometheus.GaugeVec
+	// TrackedResource enumerates the configured or discovered resources
+	TrackedResource *prometheus.GaugeVec
 }
 
-func New(nodeLabels []string) *Metrics {
+// NodePodCountBuckets are the upper bounds of the node_pod_count buckets,
+// below the +Inf one.
+var NodePodCountBuckets = []float64{0, 5, 10, 20, 30, 50, 75, 110, 150, 250}
+
+var (
+	registeredMu sync.Mutex
+	// registered holds the metrics last registered into each registry by New
+	registered = make(map[prometheus.Registerer]*Metrics)
+)
+
+// New returns the metrics registered into reg, or into the default registry
+// if reg is nil. nodeKey is the name of the label of the node name, and
+// resourceUnits maps resource names to the unit of their amounts, which is
+// documented in the metrics Help.
+//
+// New may be called again with the same registry, e.g. on reload: the
+// previously registered metrics are then reconfigured and returned, their
+// new node labels and units taking effect with the next snapshot.
+func New(reg prometheus.Registerer, nodeKey string, nodeLabels []string, resourceUnits map[string]string) *Metrics {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+
+	registeredMu.Lock()
+	defer registeredMu.Unlock()
+	if m, ok := registered[reg]; ok {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		relabeled := nodeKey != m.nodeKey || !slices.Equal(nodeLabels, m.nodeLabels)
+		m.nodeKey, m.nodeLabels, m.unitsHelp = nodeKey, nodeLabels, unitsHelp(resourceUnits)
+		if relabeled && m.NodeResourceOccupancySummary != nil {
+			// a vector cannot change its label names
+			m.newOccupancySummary()
+		}
+		return m
+	}
+
+	m := &Metrics{
+		NodeScrapes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "node_resource_exporter_node_scrape_total",
+				Help: "Number of nodes sampled, by result: 'success' if their pods were listed, 'error' otherwise.",
+			}, []string{"result"}),
+		InformerResets: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "node_resource_exporter_informer_resets_total",
+				Help: "Number of watch errors of the pod informer, each followed by a relist.",
+			}),
+		SampleInterval: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "node_resource_exporter_sample_interval_seconds",
+				Help: "Configured interval between two sampling passes, or the minimum one when sampling at scrape time.",
+			}),
+		Stale: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "node_resource_stale",
+				Help: "Whether the served metrics are those of a previous sampling pass (1), as the nodes could not be listed, or not (0).",
+			}),
+		SeriesSet: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "node_resource_exporter_series_set_total",
+				Help: "Number of series set by the sampling passes.",
+			}),
+		SeriesDeleted: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "node_resource_exporter_series_deleted_total",
+				Help: "Number of series of a sampling pass missing from the next one, e.g. of removed nodes.",
+			}),
+		InvalidValues: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "node_resource_invalid_value_total",
+				Help: "Number of node resource requests, limits or allocatable amounts left out as NaN, infinite or negative, e.g. converted from a malformed quantity.",
+			}, []string{"resource"}),
+		LabelDrift: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "node_resource_exporter_label_drift_total",
+				Help: "Number of times a node label passed onto the metrics appeared on or disappeared from a node between two sampling passes.",
+			}, []string{"label"}),
+		TickTimeouts: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "node_resource_exporter_tick_timeouts_total",
+				Help: "Number of sampling passes aborted as they exceeded the -tick-timeout.",
+			}),
+		nodeKey:    nodeKey,
+		nodeLabels: nodeLabels,
+		unitsHelp:  unitsHelp(resourceUnits),
+	}
+	m.snapshot = m.NewSnapshot()
+	reg.MustRegister(m, m.NodeScrapes, m.InformerResets, m.SampleInterval, m.Stale, m.SeriesSet, m.SeriesDeleted, m.InvalidValues, m.LabelDrift, m.TickTimeouts)
+	registered[reg] = m
+
+	return m
+}
+
+func unitsHelp(resourceUnits map[string]string) string {
+	if len(resourceUnits) == 0 {
+		return ""
+	}
+	units := make([]string, 0, len(resourceUnits))
+	for resource, unit := range resourceUnits {
+		units = append(units, fmt.Sprintf("%s in %s", resource, unit))
+	}
+	sort.Strings(units)
+	return " Units: " + strings.Join(units, ", ") + "."
+}
+
+// NewSnapshot returns an empty snapshot to be filled by a sampling pass.
+func (m *Metrics) NewSnapshot() *Snapshot {
+	m.mu.RLock()
+	node, nodeLabels, units := m.nodeKey, m.nodeLabels, m.unitsHelp
+	m.mu.RUnlock()
 	scoreLabels := append([]string{"resource"}, nodeLabels...)
-	labels := append([]string{"node"}, scoreLabels...)
+	labels := append([]string{node}, scoreLabels...)
+	nodeOnlyLabels := append([]string{node}, nodeLabels...)
+	taintLabels := append([]string{node, "key", "effect"}, nodeLabels...)
+	phaseLabels := append([]string{node, "phase"}, nodeLabels...)
+	skippedLabels := append([]string{node, "reason"}, nodeLabels...)
+	claimLabels := append([]string{node, "driver"}, nodeLabels...)
+	quantityLabels := append(append([]string{node, "resource"}, nodeLabels...), "quantity")
+	ownerLabels := append(append([]string{node, "resource"}, nodeLabels...), "namespace", "owner_kind", "owner_name")
+	priorityLabels := append(append([]string{node, "resource"}, nodeLabels...), "priority_class")
 
-	return &Metrics{
+	var collectors collectorList
+	factory := promauto.With(&collectors)
+
+	s := &Snapshot{
 		NodeLabelNames: nodeLabels,
-		NodeResourceRequests: promauto.NewGaugeVec(
+		NodeResourceRequests: factory.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Name: "node_resource_requests",
-				Help: "Gauge of node resource requests.",
+				Help: "Gauge of node resource requests." + units,
 			}, labels),
 
-		NodeResourceLimits: promauto.NewGaugeVec(
+		NodeResourceRequestsQuantity: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_resource_requests_quantity",
+				Help: "Node resource requests as an exact Kubernetes quantity in the quantity label, always 1.",
+			}, quantityLabels),
+
+		NodeResourceRequestsByOwner: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_resource_requests_by_owner",
+				Help: "Node resource requests of the pods of each top-level controller, e.g. a Deployment." + units,
+			}, ownerLabels),
+		NodeResourceRequestsByPriority: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_resource_requests_by_priority",
+				Help: "Node resource requests of the pods of each priority class, 'none' for the pods without." + units,
+			}, priorityLabels),
+
+		NodeResourceLimits: factory.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Name: "node_resource_limits",
-				Help: "Gauge of node resource limits.",
+				Help: "Gauge of node resource limits." + units,
 			}, labels),
 
-		NodeResourceOccupancy: promauto.NewGaugeVec(
+		NodeResourceOccupancy: factory.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Name: "node_resource_occupancy",
 				Help: "Occupancy percentage of node resource.",
 			}, labels),
-		NodeResourceScore: promauto.NewGaugeVec(
+		NodeResourceOverloaded: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_resource_overloaded",
+				Help: "Whether the occupancy of node resource exceeds its -occupancy-critical threshold (1) or not (0).",
+			}, labels),
+		NodeResourceWeightedOccupancy: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_resource_weighted_occupancy",
+				Help: "Occupancy percentage of node resource, weighting the requests of each pod from 1 to 2 by its priority.",
+			}, labels),
+		NodeResourceOccupancyLimits: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_resource_occupancy_limits",
+				Help: "Occupancy percentage of node resource computed from the limits, whatever -occupancy-from.",
+			}, labels),
+		NodeResourceOccupancyEWMA: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_resource_occupancy_ewma",
+				Help: "Exponentially weighted moving average of the occupancy percentage of node resource, with the -occupancy-ewma-half-life.",
+			}, labels),
+		NodeResourceScore: factory.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Name: "node_resource_score",
 				Help: "Occupancy score of node resource."}, scoreLabels),
+		NodeResourceScoreSamples: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_resource_score_samples",
+				Help: "Number of occupancy samples averaged by the score of the resource.",
+			}, scoreLabels),
+		NodeResourceScoreSum: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_resource_score_sum",
+				Help: "Sum of the occupancy samples, between 0 and 1, averaged by the score of the resource, each times its weight in seconds.",
+			}, scoreLabels),
+		NodeResourceScoreWeight: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_resource_score_weight_seconds",
+				Help: "Sum of the weights of the occupancy samples averaged by the score of the resource, the time elapsed between the passes; the average occupancy is 100 * node_resource_score_sum / node_resource_score_weight_seconds.",
+			}, scoreLabels),
+
+		NodeResourceAllocatable: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_resource_allocatable",
+				Help: "Gauge of node allocatable resource." + units,
+			}, labels),
+
+		NodeResourceAvailable: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_resource_available",
+				Help: "Gauge of node allocatable resource not yet requested." + units,
+			}, labels),
+		NodeResourceOvercommitted: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_resource_overcommitted",
+				Help: "Whether the requests of the node resource exceed its allocatable amount (1) or not (0), e.g. because of static pods or in-place resizes the scheduler did not admit.",
+			}, labels),
+
+		NodeResourceWorkloadHeadroom: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_resource_workload_headroom",
+				Help: "Gauge of node allocatable resource not requested by DaemonSet pods, which workloads may claim." + units,
+			}, labels),
+
+		NodeResourceSchedulableRatio: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_resource_schedulable_ratio",
+				Help: "Ratio of available to allocatable node resource.",
+			}, labels),
+
+		NodeResourceLimitRequestRatio: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_resource_limit_request_ratio",
+				Help: "Ratio of node resource limits to node resource requests.",
+			}, labels),
+
+		NodeResourceRequestsSidecar: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_resource_requests_sidecar",
+				Help: "Requests of node resource of the containers matching -exclude-container-names, left out of node_resource_requests." + units,
+			}, labels),
+		NodePodExceedsAllocatable: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_pod_exceeds_allocatable",
+				Help: "Whether a single running pod of the node requests more of the resource than the node allocatable (1) or not (0).",
+			}, labels),
+		NodeResourceUnboundedPodCount: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_resource_unbounded_pod_count",
+				Help: "Number of running pods on the node setting neither a request nor a limit of the resource, which consume it unaccounted by the occupancy.",
+			}, labels),
+		NodeResourceMaxContainerRequest: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_resource_max_container_request",
+				Help: "Largest single container request of node resource." + units,
+			}, labels),
+
+		NodeResourceAllocatableChanged: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "node_resource_allocatable_changed_total",
+				Help: "Number of changes of node resource allocatable between two samples, including its appearance and disappearance, e.g. when a device plugin registers.",
+			}, labels),
+
+		NodeResourceRequestsDelta: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_resource_requests_delta",
+				Help: "Change of node resource requests since the previous sample." + units,
+			}, labels),
+
+		NodeResourceEffectiveDelta: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_resource_effective_delta",
+				Help: "Effective node resource requests, including init and sidecar containers, pod overhead and pod-level resources, minus the plain sum of the app container requests." + units,
+			}, labels),
+
+		NodeResourceProvisioningGap: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_resource_provisioning_gap",
+				Help: "Node resource requests minus usage of the pods reported by the metrics server: positive if over-provisioned, negative if at risk." + units,
+			}, labels),
+
+		NodeResourceRequestsClusterFraction: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_resource_requests_cluster_fraction",
+				Help: "Fraction of the cluster-wide resource requests requested on the node.",
+			}, labels),
+
+		NodeAge: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_age_seconds",
+				Help: "Time since the node was created.",
+			}, nodeOnlyLabels),
+
+		NodeReady: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_ready_seconds",
+				Help: "Time since the node became Ready, 0 if it is not Ready.",
+			}, nodeOnlyLabels),
+
+		NodeInfo: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_info",
+				Help: "Node metadata, set to 1.",
+			}, []string{node, "provider_id", "instance_type", "os_image", "kernel_version",
+				"kubelet_version", "container_runtime_version", "os", "arch"}),
+
+		NodeTainted: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_tainted",
+				Help: "Set to 1 for each NoSchedule or NoExecute taint of the node, 0 if there is none.",
+			}, taintLabels),
+
+		NodeLastUpdate: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_resource_last_update_timestamp",
+				Help: "Unix time of the last successful refresh of the node resource metrics.",
+			}, nodeOnlyLabels),
+
+		NodePodPhaseCount: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_pod_phase_count",
+				Help: "Number of pods on the node by phase.",
+			}, phaseLabels),
+		NodePodsSkipped: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_pods_skipped",
+				Help: "Number of listed pods on the node left out of the requests and limits, by reason: 'phase' for the pods not running, 'qos' for those filtered by -qos-filter, 'terminating' for those being deleted with -exclude-terminating.",
+			}, skippedLabels),
+		NodeResourceClaims: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_resource_claims",
+				Help: "Number of devices allocated by Dynamic Resource Allocation to the ResourceClaims of the pods on the node, by driver.",
+			}, claimLabels),
+
+		NodePodCountBucket: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_pod_count_bucket",
+				Help: "Number of nodes running at most le pods in the latest sample. The buckets are cumulative like those of a histogram, but describe the latest sample rather than accumulating: use them as gauges, not with rate().",
+			}, []string{"le"}),
+		NodePodCountCount: factory.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "node_pod_count_count",
+				Help: "Number of nodes in the latest sample, the node_pod_count_bucket{le=\"+Inf\"} bucket.",
+			}),
+		NodePodCountSum: factory.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "node_pod_count_sum",
+				Help: "Number of running pods of all nodes in the latest sample. Divide it by node_pod_count_count for the average pods per node.",
+			}),
+
+		NodePodRequestOverage: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_pod_request_overage",
+				Help: "Number of running pods on the node using more cpu or memory than they request.",
+			}, nodeOnlyLabels),
+
+		NodeRequestlessPods: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_requestless_pod_count",
+				Help: "Number of running pods on the node requesting neither cpu nor memory, which are invisible to the occupancy.",
+			}, nodeOnlyLabels),
+
+		NodeContainerCount: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_container_count",
+				Help: "Number of containers of the running pods on the node, a density driving the pods-per-node and PID limits.",
+			}, nodeOnlyLabels),
+		NodeContainerRestarts: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_container_restarts_total",
+				Help: "Sum of the restart counts of the containers of the running pods on the node. It drops when restarted pods are gone.",
+			}, nodeOnlyLabels),
+
+		NodeMemoryPerCPURequested: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_memory_per_cpu_requested",
+				Help: "Bytes of memory requested on the node per cpu core requested, whatever the resource units.",
+			}, nodeOnlyLabels),
+		NodeActiveResourceCount: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_active_resource_count",
+				Help: "Number of tracked resources with non-zero requests on the node, telling single-purpose nodes from mixed-workload ones.",
+			}, nodeOnlyLabels),
+
+		NodeFitsLargestRequest: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_fits_largest_request",
+				Help: "Whether the available amount of each tracked resource of the node covers the largest request of the resource among the unscheduled pods (1) or not (0).",
+			}, nodeOnlyLabels),
+		NodeIdle: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_idle",
+				Help: "Whether none of the running pods accounted for on the node requests cpu or memory (1) or not (0), e.g. a node drained for scale-down or newly added.",
+			}, nodeOnlyLabels),
+
+		ClusterMaxNodeOccupancy: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "cluster_max_node_occupancy",
+				Help: "Occupancy percentage of the most loaded node for the resource.",
+			}, []string{"resource"}),
+		ClusterResourceAvailable: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "cluster_resource_available",
+				Help: "Sum over the nodes of the allocatable resource not yet requested, e.g. the free GPUs, overcommitted nodes counting for none." + units,
+			}, []string{"resource"}),
+		InstanceTypeResourceOccupancy: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "instancetype_resource_occupancy",
+				Help: "Occupancy percentage of the total of the nodes of the instance type for the resource.",
+			}, []string{"instance_type", "resource"}),
+		ZoneResourceOccupancySkew: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "zone_resource_occupancy_skew",
+				Help: "Difference in percentage points between the occupancies of the most and least occupied zones for the resource, each the occupancy of the total of the nodes of the zone.",
+			}, []string{"resource"}),
+		PoolResourceOccupancyMin: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "pool_resource_occupancy_min",
+				Help: "Occupancy percentage of the least loaded node of the pool for the resource.",
+			}, []string{"pool", "resource"}),
+		PoolResourceOccupancyMax: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "pool_resource_occupancy_max",
+				Help: "Occupancy percentage of the most loaded node of the pool for the resource.",
+			}, []string{"pool", "resource"}),
+		PoolResourceOccupancyAvg: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "pool_resource_occupancy_avg",
+				Help: "Average occupancy percentage of the nodes of the pool for the resource, each node counting the same.",
+			}, []string{"pool", "resource"}),
+		ClusterResourceOccupancyQuantile: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "cluster_resource_occupancy_quantile",
+				Help: "Quantile of the occupancy percentages of the nodes for the resource, over the last sampling passes.",
+			}, []string{"resource", "quantile"}),
+
+		ClusterMaxNodeOccupancyInfo: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "cluster_max_node_occupancy_info",
+				Help: "Set to 1 for the most loaded node for the resource.",
+			}, []string{"resource", node}),
+
+		ClusterUnschedulableResource: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "cluster_unschedulable_resource",
+				Help: "Number of pending pods not bound to a node requesting the extended resource, which no node advertises.",
+			}, []string{"resource"}),
+		ClusterUnscheduledPodCount: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "cluster_unscheduled_pod_count",
+				Help: "Number of pending pods not bound to a node, by whether they request cpu or memory.",
+			}, []string{"requests"}),
+
+		NamespaceResourceQuotaUsed: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "namespace_resource_quota_used",
+				Help: "Amount of the resource used in the namespace, as accounted by the ResourceQuota.",
+			}, []string{"namespace", "quota", "resource"}),
+		NamespaceResourceQuotaHard: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "namespace_resource_quota_hard",
+				Help: "Hard limit of the resource in the namespace set by the ResourceQuota.",
+			}, []string{"namespace", "quota", "resource"}),
+
+		InformerSynced: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_resource_exporter_informer_synced",
+				Help: "Set to 1 if the pod informer cache is synced and received the pods relisted after its last watch error, 0 otherwise, e.g. while its watch is disconnected.",
+			}, nil),
+		UnusedLabelKeys: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_resource_exporter_unused_label_keys",
+				Help: "Number of the node labels of the metrics that no node has, e.g. misspelled, whose values are all empty.",
+			}, nil),
+		NodesNotReadyForMetrics: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_resource_exporter_nodes_not_ready_for_metrics",
+				Help: "Number of nodes whose resource metrics are left out as they report no allocatable resources yet, e.g. freshly registered.",
+			}, nil),
+		TrackedResource: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "node_resource_exporter_tracked_resource",
+				Help: "Set to 1 for each resource tracked by the exporter, as configured by -r or discovered on the nodes.",
+			}, []string{"resource"}),
+	}
+	s.collectors = collectors
+
+	return s
+}
+
+// Update publishes the snapshot to be exposed on subsequent scrapes.
+func (m *Metrics) Update(s *Snapshot) {
+	series := s.seriesKeys()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	deleted := 0
+	for key := range m.series {
+		if !series[key] {
+			deleted++
+		}
+	}
+	m.generation++
+	s.generation = m.generation
+	m.snapshot, m.series = s, series
+	m.SeriesSet.Add(float64(len(series)))
+	m.SeriesDeleted.Add(float64(deleted))
+}
+
+// seriesKeys returns a key identifying each series of the snapshot.
+func (s *Snapshot) seriesKeys() map[string]bool {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		for _, c := range s.collectors {
+			c.Collect(ch)
+		}
+		close(ch)
+	}()
+
+	keys := make(map[string]bool)
+	for metric := range ch {
+		var pb dto.Metric
+		if err := metric.Write(&pb); err != nil {
+			continue
+		}
+		var key strings.Builder
+		key.WriteString(metric.Desc().String())
+		for _, lp := range pb.GetLabel() {
+			key.WriteString("\xff" + lp.GetName() + "=" + lp.GetValue())
+		}
+		keys[key.String()] = true
+	}
+	return keys
+}
+
+func (m *Metrics) current() *Snapshot {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.snapshot
+}
+
+// EnableOccupancySummary creates the NodeResourceOccupancySummary, observing
+// the occupancies of the last window for the quantile objectives, and makes
+// Collect expose it. Each objective adds a series per node resource. It does
+// nothing if already enabled.
+func (m *Metrics) EnableOccupancySummary(quantiles []float64, window time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.NodeResourceOccupancySummary != nil {
+		return
 	}
+	objectives := make(map[float64]float64, len(quantiles))
+	for _, q := range quantiles {
+		// the error tolerance shrinks towards the tails
+		objectives[q] = (1 - q) / 10
+	}
+	m.summaryOpts = prometheus.SummaryOpts{
+		Name:       "node_resource_occupancy_summary",
+		Help:       "Occupancy percentage of node resource over the last samples.",
+		Objectives: objectives,
+		MaxAge:     window,
+	}
+	m.newOccupancySummary()
+}
+
+// newOccupancySummary creates NodeResourceOccupancySummary with the current
+// node labels. It is collected along the snapshot rather than registered, as
+// a registry rejects a metric changing its label names.
+func (m *Metrics) newOccupancySummary() {
+	m.NodeResourceOccupancySummary = prometheus.NewSummaryVec(m.summaryOpts, append([]string{m.nodeKey, "resource"}, m.nodeLabels...))
 }
 
-type ResourceScore struct {
-	scores map[string]*Score
+// EnablePodDensityHistogram creates and registers into reg the
+// NodePodDensity native histogram, without classic buckets. It does nothing
+// if already enabled.
+func (m *Metrics) EnablePodDensityHistogram(reg prometheus.Registerer) {
+	if m.NodePodDensity != nil {
+		return
+	}
+	m.NodePodDensity = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:                            "node_pod_density",
+			Help:                            "Running pods of each node, observed at each sampling pass. It is a native histogram, whose buckets are only exposed in the protobuf format.",
+			NativeHistogramBucketFactor:     1.1,
+			NativeHistogramMaxBucketNumber:  160,
+			NativeHistogramMinResetDuration: time.Hour,
+		})
+	reg.MustRegister(m.NodePodDensity)
 }
 
-type Score struct {
-	total float64
-	count int64
+// SetRefresher makes Collect call refresh to take a new snapshot before
+// exposing it. Concurrent scrapes within ttl share the same snapshot.
+func (m *Metrics) SetRefresher(refresh func(), ttl time.Duration) {
+	m.refreshMu.Lock()
+	defer m.refreshMu.Unlock()
+	m.refresh = refresh
+	m.refreshTTL = ttl
 }
 
-func NewResourceScore() *ResourceScore {
-	return &ResourceScore{
-		scores: make(map[string]*Score),
+func (m *Metrics) maybeRefresh() {
+	m.refreshMu.Lock()
+	defer m.refreshMu.Unlock()
+	if m.refresh == nil || time.Since(m.refreshed) < m.refreshTTL {
+		return
+	}
+	m.refresh()
+	m.refreshed = time.Now()
+}
+
+// Describe implements prometheus.Collector. It sends no descriptors,
+// making Metrics an unchecked collector.
+func (m *Metrics) Describe(chan<- *prometheus.Desc) {}
+
+// generationDesc describes the generation of the snapshot of a scrape.
+var generationDesc = prometheus.NewDesc(
+	"node_resource_exporter_generation",
+	"Generation of the sampling pass of the served metrics, increasing with each pass. All the series of a scrape come from this pass.",
+	nil, nil)
+
+// Collect implements prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.maybeRefresh()
+	snapshot := m.current()
+	for _, c := range snapshot.collectors {
+		c.Collect(ch)
+	}
+	m.mu.RLock()
+	summary := m.NodeResourceOccupancySummary
+	m.mu.RUnlock()
+	if summary != nil {
+		summary.Collect(ch)
 	}
+	ch <- prometheus.MustNewConstMetric(generationDesc, prometheus.GaugeValue, float64(snapshot.generation))
 }
 
-func (s *ResourceScore) Score(resource string, occ float64) float64 {
-	score, ok := s.scores[resource]
-	if !ok {
-		score = &Score{total: occ, count: 1}
-	} else {
-		score.total += occ
-		score.count++
+// collectorList is a prometheus.Registerer that only records the collectors
+// created for a snapshot.
+type collectorList []prometheus.Collector
+
+func (l *collectorList) Register(c prometheus.Collector) error {
+	*l = append(*l, c)
+	return nil
+}
+
+func (l *collectorList) MustRegister(cs ...prometheus.Collector) {
+	*l = append(*l, cs...)
+}
+
+func (l *collectorList) Unregister(c prometheus.Collector) bool {
+	for i := range *l {
+		if (*l)[i] == c {
+			*l = append((*l)[:i], (*l)[i+1:]...)
+			return true
+		}
 	}
-	s.scores[resource] = score
+	return false
+}
 
-	return 100.0 * score.total / float64(score.count)
+// Gatherer returns a prometheus.Gatherer of the series of the current
+// Snapshot only, so that they can be shared with other exporters. The
+// labels, if any, are added to every series.
+func (m *Metrics) Gatherer(labels prometheus.Labels) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		reg := prometheus.NewPedanticRegistry()
+		if err := prometheus.WrapRegistererWith(labels, reg).Register(m); err != nil {
+			return nil, err
+		}
+		return reg.Gather()
+	})
+}
+
+// NodeGatherer returns a prometheus.Gatherer of the series of g whose nodeKey
+// label is the node.
+func NodeGatherer(g prometheus.Gatherer, nodeKey, node string) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := g.Gather()
+		if err != nil {
+			return nil, err
+		}
+		filtered := families[:0]
+		for _, mf := range families {
+			metrics := mf.Metric[:0]
+			for _, metric := range mf.Metric {
+				if hasLabel(metric, nodeKey, node) {
+					metrics = append(metrics, metric)
+				}
+			}
+			if len(metrics) > 0 {
+				mf.Metric = metrics
+				filtered = append(filtered, mf)
+			}
+		}
+		return filtered, nil
+	})
+}
+
+func hasLabel(metric *dto.Metric, name, value string) bool {
+	for _, lp := range metric.GetLabel() {
+		if lp.GetName() == name {
+			return lp.GetValue() == value
+		}
+	}
+	return false
 }
@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestNewTwice(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	first := New(reg, "node", []string{"zone"}, nil)
+	// a reload reconfigures the metrics registered first
+	second := New(reg, "node", []string{"zone", "rack"}, nil)
+	if first != second {
+		t.Fatal("New returned other metrics for the same registry")
+	}
+
+	snapshot := second.NewSnapshot()
+	snapshot.NodeResourceRequests.WithLabelValues("node-a", "cpu", "zone-a", "rack-1").Set(1)
+	second.Update(snapshot)
+	second.NodeScrapes.WithLabelValues("success").Inc()
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics: %v", err)
+	}
+	series := make(map[string]int)
+	for _, family := range families {
+		series[family.GetName()] += len(family.GetMetric())
+	}
+	for name, want := range map[string]int{
+		"node_resource_requests":                   1,
+		"node_resource_exporter_node_scrape_total": 1,
+	} {
+		if series[name] != want {
+			t.Errorf("%d series of %s, want %d", series[name], name, want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultHistorySize is the number of samples of each resource kept by a
+// ResourceScore for History, unless changed by SetHistorySize.
+const DefaultHistorySize = 1024
+
+// ResourceScore is the default Scorer. Its methods may be called
+// concurrently, e.g. History by an embedder while the passes add samples.
+type ResourceScore struct {
+	mu     sync.Mutex
+	scores map[string]*Score
+	// interval is the nominal sampling interval, weighting the first pass
+	// of a resource which has no previous pass to measure the elapsed time
+	interval    time.Duration
+	historySize int
+}
+
+// Sample is an occupancy, between 0 and 1, added to a score at a given time.
+type Sample struct {
+	Time      time.Time
+	Occupancy float64
+}
+
+// Score is the average occupancy of a resource over time: the samples of a
+// pass are weighted by the time elapsed since the previous pass, so that
+// passes delayed e.g. by a slow API server do not bias the average.
+type Score struct {
+	total    float64
+	weight   float64
+	samples  int
+	elapsed  time.Duration
+	lastSeen time.Time
+	// nodes holds the terms added by each node, to take them out of the
+	// average once the node is no longer sampled
+	nodes map[string]*nodeScore
+	// history holds the last samples, a ring buffer of which next is the
+	// oldest sample once full
+	history []Sample
+	next    int
+}
+
+// nodeScore holds the terms of a Score added by the samples of a node.
+type nodeScore struct {
+	total    float64
+	weight   float64
+	samples  int
+	lastSeen time.Time
+}
+
+// ScoreStats are the terms of the average of a Score: the score is 100 times
+// Total divided by Weight.
+type ScoreStats struct {
+	// Samples is the number of samples added
+	Samples int
+	// Total is the sum of the occupancies, between 0 and 1, of the samples
+	// times their weight
+	Total float64
+	// Weight is the sum of the weights of the samples, in seconds
+	Weight float64
+}
+
+func NewResourceScore(interval time.Duration) *ResourceScore {
+	return &ResourceScore{
+		scores:      make(map[string]*Score),
+		interval:    interval,
+		historySize: DefaultHistorySize,
+	}
+}
+
+// SetHistorySize sets the number of samples of each resource kept for
+// History, 0 keeping none. The samples kept so far are dropped.
+func (s *ResourceScore) SetHistorySize(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.historySize = max(n, 0)
+	for _, score := range s.scores {
+		score.history, score.next = nil, 0
+	}
+}
+
+// History returns the last samples of the resource, oldest first, at most
+// the history size. All the samples of a pass share its time.
+func (s *ResourceScore) History(resource string) []Sample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	score, ok := s.scores[resource]
+	if !ok {
+		return nil
+	}
+	history := make([]Sample, 0, len(score.history))
+	history = append(history, score.history[score.next:]...)
+	return append(history, score.history[:score.next]...)
+}
+
+// Score adds the occupancy of the node sampled by the pass at the given time,
+// and returns the score of the resource. All the samples of a pass share its
+// time.
+func (s *ResourceScore) Score(resource, node string, occ float64, now time.Time) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	score, ok := s.scores[resource]
+	if !ok {
+		score = &Score{elapsed: s.interval, lastSeen: now, nodes: make(map[string]*nodeScore)}
+		s.scores[resource] = score
+	} else if now.After(score.lastSeen) {
+		score.elapsed = now.Sub(score.lastSeen)
+		score.lastSeen = now
+	}
+	contribution, ok := score.nodes[node]
+	if !ok {
+		contribution = &nodeScore{}
+		score.nodes[node] = contribution
+	}
+	weight := score.elapsed.Seconds()
+	score.total += occ * weight
+	score.weight += weight
+	score.samples++
+	contribution.total += occ * weight
+	contribution.weight += weight
+	contribution.samples++
+	contribution.lastSeen = now
+	if len(score.history) < s.historySize {
+		score.history = append(score.history, Sample{Time: now, Occupancy: occ})
+	} else if s.historySize > 0 {
+		score.history[score.next] = Sample{Time: now, Occupancy: occ}
+		score.next = (score.next + 1) % s.historySize
+	}
+
+	if score.weight == 0 {
+		return 100.0 * occ
+	}
+	return 100.0 * score.total / score.weight
+}
+
+// Stats returns the terms of the score of the resource, if sampled.
+func (s *ResourceScore) Stats(resource string) (ScoreStats, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	score, ok := s.scores[resource]
+	if !ok {
+		return ScoreStats{}, false
+	}
+	return ScoreStats{Samples: score.samples, Total: score.total, Weight: score.weight}, true
+}
+
+// Expire takes the samples of the nodes which have not sampled a resource
+// since the given time out of its score, and forgets the scores no node
+// samples anymore, so that drained or removed nodes and resources which are
+// gone do not keep their historical load.
+func (s *ResourceScore) Expire(since time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for resource, score := range s.scores {
+		for node, contribution := range score.nodes {
+			if contribution.lastSeen.Before(since) {
+				score.total -= contribution.total
+				score.weight -= contribution.weight
+				score.samples -= contribution.samples
+				delete(score.nodes, node)
+			}
+		}
+		if len(score.nodes) == 0 {
+			delete(s.scores, resource)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestResourceScoreExpire(t *testing.T) {
+	start := time.Unix(0, 0)
+	tests := []struct {
+		name string
+		// busy samples the busy node until the given pass, the idle one
+		// samples all the passes
+		busyPasses int
+		passes     int
+		since      int
+		wantScore  float64
+		wantStats  bool
+	}{
+		{name: "both nodes sampled", busyPasses: 4, passes: 4, since: 3, wantScore: 50, wantStats: true},
+		{name: "busy node expired", busyPasses: 2, passes: 4, since: 3, wantScore: 0, wantStats: true},
+		{name: "busy node within the TTL", busyPasses: 3, passes: 4, since: 3, wantScore: 100.0 * 3 / 7, wantStats: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewResourceScore(10 * time.Second)
+			for i := range tt.passes {
+				now := start.Add(time.Duration(i) * 10 * time.Second)
+				if i < tt.busyPasses {
+					s.Score("cpu", "busy", 1, now)
+				}
+				s.Score("cpu", "idle", 0, now)
+			}
+			s.Expire(start.Add(time.Duration(tt.since-1) * 10 * time.Second))
+			stats, ok := s.Stats("cpu")
+			if ok != tt.wantStats {
+				t.Fatalf("stats found %v, want %v", ok, tt.wantStats)
+			}
+			if score := 100 * stats.Total / stats.Weight; math.Abs(score-tt.wantScore) > 1e-9 {
+				t.Errorf("score %v, want %v", score, tt.wantScore)
+			}
+		})
+	}
+
+	t.Run("score of no node forgotten", func(t *testing.T) {
+		s := NewResourceScore(10 * time.Second)
+		s.Score("cpu", "gone", 1, start)
+		s.Expire(start.Add(time.Second))
+		if _, ok := s.Stats("cpu"); ok {
+			t.Errorf("score of cpu kept without nodes")
+		}
+		if score := s.Score("cpu", "new", 0.5, start.Add(time.Minute)); score != 50 {
+			t.Errorf("score %v after the expiry, want 50", score)
+		}
+	})
+}
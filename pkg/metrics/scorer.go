@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+)
+
+// Scorer computes the score of a resource from the occupancy of a node,
+// between 0 and 1, sampled by the pass at the given time. ResourceScore is
+// the default. Stats returns the terms of the average occupancy of the
+// resource, and Expire forgets the nodes not sampled since the given time.
+type Scorer interface {
+	Score(resource, node string, occ float64, now time.Time) float64
+	Stats(resource string) (ScoreStats, bool)
+	Expire(since time.Time)
+}
+
+// ScoreExpr is a compiled -score-expr expression. The expression evaluates to
+// the score of a resource, given the variables:
+//
+//	resource  the resource name
+//	occ       the occupancy percentage
+//	avg       the score of the default scorer, the time-weighted average occupancy
+//	prev      the previous score of the resource, occ on its first sample
+//
+// and the function ema(x, alpha) returning alpha*x + (1-alpha)*prev.
+type ScoreExpr struct {
+	program *vm.Program
+}
+
+// scoreEnv returns the variables and functions of the score expressions.
+func scoreEnv(resource string, occ, avg, prev float64) map[string]any {
+	return map[string]any{
+		"resource": resource,
+		"occ":      occ,
+		"avg":      avg,
+		"prev":     prev,
+		"ema": func(x, alpha float64) float64 {
+			return alpha*x + (1-alpha)*prev
+		},
+	}
+}
+
+// CompileScoreExpr compiles the score expression.
+func CompileScoreExpr(expression string) (*ScoreExpr, error) {
+	program, err := expr.Compile(expression, expr.Env(scoreEnv("", 0, 0, 0)), expr.AsFloat64())
+	if err != nil {
+		return nil, fmt.Errorf("invalid score expression %q: %w", expression, err)
+	}
+	return &ScoreExpr{program: program}, nil
+}
+
+// NewScorer returns a Scorer evaluating the expression, with its own history.
+// The interval is the one of the underlying ResourceScore, whose score is also
+// returned if the evaluation fails.
+func (e *ScoreExpr) NewScorer(interval time.Duration) Scorer {
+	return &exprScorer{
+		program: e.program,
+		avg:     NewResourceScore(interval),
+		prev:    make(map[string]float64),
+	}
+}
+
+type exprScorer struct {
+	program *vm.Program
+	avg     *ResourceScore
+	prev    map[string]float64
+}
+
+func (s *exprScorer) Score(resource, node string, occ float64, now time.Time) float64 {
+	avg := s.avg.Score(resource, node, occ, now)
+	prev, ok := s.prev[resource]
+	if !ok {
+		prev = 100.0 * occ
+	}
+	out, err := expr.Run(s.program, scoreEnv(resource, 100.0*occ, avg, prev))
+	if err != nil {
+		// keep the sampling going, falling back to the default score
+		out = avg
+	}
+	score := out.(float64)
+	s.prev[resource] = score
+	return score
+}
+
+func (s *exprScorer) Stats(resource string) (ScoreStats, bool) {
+	return s.avg.Stats(resource)
+}
+
+func (s *exprScorer) Expire(since time.Time) {
+	s.avg.Expire(since)
+	s.avg.mu.Lock()
+	defer s.avg.mu.Unlock()
+	for resource := range s.prev {
+		if _, ok := s.avg.scores[resource]; !ok {
+			delete(s.prev, resource)
+		}
+	}
+}